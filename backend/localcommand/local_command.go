@@ -90,6 +90,17 @@ func (lcmd *LocalCommand) Close() error {
 	}
 }
 
+// ExitStatus returns the exit status of the command,
+// or -1 when the command has not exited in the close timeout.
+func (lcmd *LocalCommand) ExitStatus() int {
+	select {
+	case <-lcmd.ptyClosed:
+		return lcmd.cmd.ProcessState.ExitCode()
+	case <-lcmd.closeTimeoutC():
+		return -1
+	}
+}
+
 func (lcmd *LocalCommand) WindowTitleVariables() map[string]interface{} {
 	return map[string]interface{}{
 		"command": lcmd.command,
@@ -74,7 +74,7 @@ func (server *Server) generateHandleWS(ctx context.Context, cancel context.Cance
 
 		err = server.processWSConn(ctx, conn)
 
-		switch err {
+		switch errors.Cause(err) {
 		case ctx.Err():
 			closeReason = "cancelation"
 		case webtty.ErrSlaveClosed:
@@ -2,6 +2,8 @@ package server
 
 import (
 	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/webtty"
 )
 
 type Options struct {
@@ -38,6 +40,9 @@ func (options *Options) Validate() error {
 	if options.EnableTLSClientAuth && !options.EnableTLS {
 		return errors.New("TLS client authentication is enabled, but TLS is not enabled")
 	}
+	if options.EnableReconnect && (options.ReconnectTime < 0 || options.ReconnectTime > webtty.MaxReconnect) {
+		return errors.Errorf("reconnect time must be between 0 and %d seconds", webtty.MaxReconnect)
+	}
 	return nil
 }
 
@@ -2,6 +2,8 @@ package server
 
 import (
 	"github.com/gorilla/websocket"
+
+	"github.com/yudai/gotty/webtty"
 )
 
 type wsWrapper struct {
@@ -9,7 +11,13 @@ type wsWrapper struct {
 }
 
 func (wsw *wsWrapper) Write(p []byte) (n int, err error) {
-	writer, err := wsw.Conn.NextWriter(websocket.TextMessage)
+	messageType := websocket.TextMessage
+	if len(p) > 0 && p[0] == webtty.BinaryOutput {
+		// raw output of the slave is not always valid UTF-8
+		messageType = websocket.BinaryMessage
+	}
+
+	writer, err := wsw.Conn.NextWriter(messageType)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,37 @@
+package webtty
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+var oscClipboard = []byte("52;")
+
+// forwardClipboard sends text that the slave requests to copy to
+// the clipboard with OSC 52 to the master in a Clipboard message.
+// params is the string of the sequence after `52;`.
+// Requests to read the clipboard are ignored.
+func (wt *WebTTY) forwardClipboard(params []byte) error {
+	// OSC 52 ; Pc ; Pd, where Pc selects the clipboard
+	fields := bytes.SplitN(params, []byte(";"), 2)
+	if len(fields) != 2 || bytes.Equal(fields[1], []byte("?")) {
+		return nil
+	}
+
+	text, err := base64.StdEncoding.DecodeString(string(fields[1]))
+	if err != nil {
+		log.Printf("Ignoring malformed clipboard data: %s (session %s)", err, wt.sessionID)
+		return nil
+	}
+
+	message, _ := json.Marshal(string(text))
+	err = wt.masterWrite(Message{Clipboard, message})
+	if err != nil {
+		return errors.Wrapf(err, "failed to send clipboard data")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package webtty
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCoalesceDelay is used when WithOutputCoalesce is given no delay
+	DefaultCoalesceDelay = 5 * time.Millisecond
+	// DefaultCoalesceBytes is used when WithOutputCoalesce is given no size
+	DefaultCoalesceBytes = 16 * 1024
+)
+
+// coalescer accumulates small chunks of slave output into one message.
+type coalescer struct {
+	maxDelay time.Duration
+	maxBytes int
+
+	mutex   sync.Mutex
+	pending []byte
+	timer   *time.Timer
+	// error of a flush triggered by the timer
+	err error
+}
+
+// coalesceOutput queues data to be sent to the master,
+// flushing it when enough bytes are queued.
+func (wt *WebTTY) coalesceOutput(data []byte) error {
+	c := wt.coalescer
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	c.pending = append(c.pending, data...)
+	if len(c.pending) >= c.maxBytes {
+		return wt.flushPendingOutputLocked()
+	}
+
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.maxDelay, func() {
+			// the slave can be quiet, so Run isn't told by the next read
+			err := wt.flushPendingOutput()
+			if err != nil {
+				wt.reportError(err)
+			}
+		})
+	}
+
+	return nil
+}
+
+// flushPendingOutput sends queued output to the master.
+func (wt *WebTTY) flushPendingOutput() error {
+	c := wt.coalescer
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := wt.flushPendingOutputLocked()
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+// stopOutputCoalesce drops queued output and stops the flush timer,
+// so nothing is sent to the master after Run returns.
+func (wt *WebTTY) stopOutputCoalesce() {
+	c := wt.coalescer
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.pending = c.pending[:0]
+}
+
+func (wt *WebTTY) flushPendingOutputLocked() error {
+	c := wt.coalescer
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	err := wt.sendOutput(c.pending)
+	c.pending = c.pending[:0]
+	return err
+}
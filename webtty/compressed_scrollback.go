@@ -0,0 +1,103 @@
+package webtty
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+// scrollbackBlockSize is the number of bytes compressed together
+// by compressedScrollback.
+const scrollbackBlockSize = 64 * 1024
+
+// scrollbackBuffer keeps the last output of the slave for replaying.
+type scrollbackBuffer interface {
+	Write(data []byte)
+	Bytes() []byte
+}
+
+// compressedScrollback works like scrollback, but keeps the output
+// compressed with deflate in blocks of scrollbackBlockSize bytes.
+// Only the latest block is kept raw until it's filled up.
+// Blocks are dropped as a whole, so up to a block more than size bytes
+// are kept, and Bytes trims them.
+type compressedScrollback struct {
+	size   int
+	blocks []compressedBlock // the oldest first
+	length int               // total raw length of blocks
+	tail   []byte
+}
+
+type compressedBlock struct {
+	data   []byte
+	length int
+}
+
+func newCompressedScrollback(size int) *compressedScrollback {
+	return &compressedScrollback{size: size}
+}
+
+// Write appends data, discarding the oldest blocks when they are not needed anymore.
+func (cs *compressedScrollback) Write(data []byte) {
+	for len(data) > 0 {
+		n := scrollbackBlockSize - len(cs.tail)
+		if n > len(data) {
+			n = len(data)
+		}
+		cs.tail = append(cs.tail, data[:n]...)
+		data = data[n:]
+
+		if len(cs.tail) == scrollbackBlockSize {
+			cs.seal()
+		}
+	}
+
+	// the tail and later blocks are enough to keep size bytes
+	for len(cs.blocks) > 0 && cs.length-cs.blocks[0].length+len(cs.tail) >= cs.size {
+		cs.length -= cs.blocks[0].length
+		cs.blocks[0] = compressedBlock{}
+		cs.blocks = cs.blocks[1:]
+	}
+}
+
+// seal compresses the tail into a new block.
+// The writer isn't kept, as its state is larger than a few blocks.
+func (cs *compressedScrollback) seal() {
+	var buffer bytes.Buffer
+	// never fails with a valid level
+	writer, _ := flate.NewWriter(&buffer, flate.BestSpeed)
+	// writing to a bytes.Buffer never fails
+	writer.Write(cs.tail)
+	writer.Close()
+
+	// copied not to keep the spare capacity of the buffer
+	data := append([]byte(nil), buffer.Bytes()...)
+	cs.blocks = append(cs.blocks, compressedBlock{data: data, length: len(cs.tail)})
+	cs.length += len(cs.tail)
+	cs.tail = cs.tail[:0]
+}
+
+// Bytes returns the last size bytes decompressed, the oldest first.
+func (cs *compressedScrollback) Bytes() []byte {
+	data := make([]byte, 0, cs.length+len(cs.tail))
+	for _, block := range cs.blocks {
+		// blocks are compressed by seal and always valid
+		raw, _ := ioutil.ReadAll(flate.NewReader(bytes.NewReader(block.data)))
+		data = append(data, raw...)
+	}
+	data = append(data, cs.tail...)
+
+	if len(data) > cs.size {
+		data = data[len(data)-cs.size:]
+	}
+	return data
+}
+
+// memorySize returns the number of bytes used to keep the output.
+func (cs *compressedScrollback) memorySize() int {
+	n := cap(cs.tail)
+	for _, block := range cs.blocks {
+		n += cap(block.data)
+	}
+	return n
+}
@@ -0,0 +1,107 @@
+package webtty
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// compressor encodes output into CompressedOutput payloads.
+type compressor struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+	writer *flate.Writer
+}
+
+// compressFrame returns a CompressedOutput message of data
+// in a buffer from framePool.
+// Each payload is a complete deflate stream and can be decompressed alone.
+func (c *compressor) compressFrame(data []byte) (*[]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.buffer.Reset()
+	if c.writer == nil {
+		writer, err := flate.NewWriter(&c.buffer, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		c.writer = writer
+	} else {
+		c.writer.Reset(&c.buffer)
+	}
+
+	_, err := c.writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = c.writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	frame := getFrame(1 + base64.StdEncoding.EncodedLen(c.buffer.Len()))
+	(*frame)[0] = CompressedOutput
+	base64.StdEncoding.Encode((*frame)[1:], c.buffer.Bytes())
+	return frame, nil
+}
+
+func (wt *WebTTY) compressionAcknowledged() bool {
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+	return wt.compressionAcked
+}
+
+// outputFrame builds a message to send output of the slave to the master
+// in a buffer from framePool, which should be returned with putFrame.
+// Output is compressed only when the master has acknowledged compression,
+// and sent without encoding when the master supports binary output.
+func (wt *WebTTY) outputFrame(data []byte) (*[]byte, error) {
+	if wt.compression != nil && wt.compressionAcknowledged() {
+		frame, err := wt.compression.compressFrame(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compress output")
+		}
+		return frame, nil
+	}
+
+	if wt.binaryOutputEnabled() {
+		frame := getFrame(1 + len(data))
+		(*frame)[0] = BinaryOutput
+		copy((*frame)[1:], data)
+		return frame, nil
+	}
+
+	frame := getFrame(1 + wt.outputEncoding.encodedLen(len(data)))
+	(*frame)[0] = Output
+	wt.outputEncoding.encode((*frame)[1:], data)
+	return frame, nil
+}
+
+// maxOutputChunk returns the maximum size of output to send in one message
+// to keep the message within the max frame size, or zero when unlimited.
+// Output encoded in base64 is split at multiples of 3 bytes,
+// so that each message is a complete base64 string.
+func (wt *WebTTY) maxOutputChunk() int {
+	if wt.maxFrameSize <= 0 {
+		return 0
+	}
+
+	compressed := wt.compression != nil && wt.compressionAcknowledged()
+	if !compressed {
+		if wt.binaryOutputEnabled() {
+			return wt.maxFrameSize - 1
+		}
+		return wt.outputEncoding.maxDecodedLen(wt.maxFrameSize - 1)
+	}
+
+	// compressed output is always encoded in base64, and
+	// incompressible output grows by the headers of stored blocks,
+	// 5 bytes for each 65535 bytes, and the final block
+	limit := (wt.maxFrameSize - 1) / 4 * 3
+	limit -= (limit/65535+1)*5 + 8
+	return limit
+}
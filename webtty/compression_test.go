@@ -0,0 +1,105 @@
+package webtty
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func decompressOutput(t testing.TB, payload []byte) []byte {
+	compressed, err := base64.StdEncoding.DecodeString(string(payload))
+	if err != nil {
+		t.Fatalf("Unexpected error from DecodeString(): %s", err)
+	}
+	decompressed, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatalf("Unexpected error from ReadAll(): %s", err)
+	}
+	return decompressed
+}
+
+func TestCompression(t *testing.T) {
+	ts := newTestSession(t, WithCompression())
+	defer ts.close(t)
+
+	ts.readFrame(t) // window title
+	frame := ts.readFrame(t)
+	if !bytes.Equal(frame, []byte{SetCompression, 'd', 'e', 'f', 'l', 'a', 't', 'e'}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	ts.readFrame(t) // protocol info
+
+	// not acknowledged yet
+	ts.slaveOut.Write([]byte("foobar"))
+	frame = ts.readFrame(t)
+	if frame[0] != Output {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+
+	ts.masterIn.Write([]byte{AckCompression})
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+
+	ts.slaveOut.Write([]byte("foobar"))
+	frame = ts.readFrame(t)
+	if frame[0] != CompressedOutput {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+	if decompressed := decompressOutput(t, frame[1:]); !bytes.Equal(decompressed, []byte("foobar")) {
+		t.Fatalf("Unexpected output received: `%s`", decompressed)
+	}
+}
+
+func TestCompressionNotAdvertised(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	// the acknowledgement is ignored when compression is disabled
+	ts.masterIn.Write([]byte{AckCompression})
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+
+	ts.slaveOut.Write([]byte("foobar"))
+	frame := ts.readFrame(t)
+	if frame[0] != Output {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+}
+
+// logChunk is a typical chunk of output of a log heavy session.
+func logChunk(size int) []byte {
+	buf := new(bytes.Buffer)
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(buf, "2017-08-21T10:%02d:%02d.000Z INFO  [worker-%d] processed request id=%08x status=200 duration=%dms\r\n", i/60%60, i%60, i%8, i*7919, i%250)
+	}
+	return buf.Bytes()[:size]
+}
+
+func benchmarkOutputFrame(b *testing.B, wt *WebTTY) {
+	chunk := logChunk(1024)
+	frameBytes := 0
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame, err := wt.outputFrame(chunk)
+		if err != nil {
+			b.Fatalf("Unexpected error from outputFrame(): %s", err)
+		}
+		frameBytes += len(*frame)
+		putFrame(frame)
+	}
+	b.ReportMetric(float64(frameBytes)/float64(b.N), "bytes/frame")
+}
+
+func BenchmarkOutputFrameUncompressed(b *testing.B) {
+	benchmarkOutputFrame(b, &WebTTY{})
+}
+
+func BenchmarkOutputFrameCompressed(b *testing.B) {
+	benchmarkOutputFrame(b, &WebTTY{compression: &compressor{}, compressionAcked: true})
+}
@@ -0,0 +1,94 @@
+package webtty
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// maxConnMessageSize is the maximum size of a message read by a conn master.
+const maxConnMessageSize = 16 * 1024 * 1024
+
+// connMaster is a master over a byte stream such as TCP or a Unix socket.
+// As streams don't keep boundaries of messages, each message is prefixed
+// with its length in 4 bytes of big endian.
+type connMaster struct {
+	conn io.ReadWriteCloser
+}
+
+// NewConnMaster returns a master using a stream such as a net.Conn.
+// Messages are framed with their length, so the other end of the stream
+// should wrap the stream with NewConnMaster as well to exchange messages.
+func NewConnMaster(conn io.ReadWriteCloser) Master {
+	return &connMaster{conn: conn}
+}
+
+// Read reads one message. Like websocket masters, a message longer than p
+// is truncated to the length of p.
+func (cm *connMaster) Read(p []byte) (int, error) {
+	var header [4]byte
+	_, err := io.ReadFull(cm.conn, header[:])
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	if size > maxConnMessageSize {
+		return 0, errors.Errorf("message too large: %d bytes", size)
+	}
+
+	n := len(p)
+	if int64(n) > size {
+		n = int(size)
+	}
+	_, err = io.ReadFull(cm.conn, p[:n])
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = io.CopyN(ioutil.Discard, cm.conn, size-int64(n))
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Write writes p as one message.
+func (cm *connMaster) Write(p []byte) (int, error) {
+	frame := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(frame, uint32(len(p)))
+	copy(frame[4:], p)
+
+	n, err := cm.conn.Write(frame)
+	n -= 4
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (cm *connMaster) Close() error {
+	return cm.conn.Close()
+}
+
+// connSlave is a slave over a byte stream.
+// The stream can't be resized and has no window title variables.
+type connSlave struct {
+	io.ReadWriteCloser
+}
+
+// NewConnSlave returns a slave using a stream such as a net.Conn.
+func NewConnSlave(conn io.ReadWriteCloser) Slave {
+	return &connSlave{conn}
+}
+
+func (cs *connSlave) WindowTitleVariables() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (cs *connSlave) ResizeTerminal(columns int, rows int) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package webtty
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"testing"
+)
+
+func TestConnMaster(t *testing.T) {
+	masterConn, clientConn := net.Pipe()
+	slaveConn, commandConn := net.Pipe()
+	defer clientConn.Close()
+	defer commandConn.Close()
+
+	dt, err := New(NewConnMaster(masterConn), NewConnSlave(slaveConn), WithPermitWrite())
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dt.Run(ctx)
+
+	client := NewConnMaster(clientConn)
+	buf := make([]byte, 1024)
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read(): %s", err)
+		}
+		if buf[0] == SetProtocolInfo && n > 1 {
+			break
+		}
+	}
+
+	// input and ping sent back to back are read as separate messages
+	go func() {
+		client.Write([]byte{Input, 'l', 's'})
+		client.Write([]byte{Ping})
+	}()
+
+	n, err := commandConn.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read(): %s", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("ls")) {
+		t.Fatalf("Unexpected input written: `%s`", buf[:n])
+	}
+
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read(): %s", err)
+	}
+	if !bytes.Equal(buf[:n], []byte{Pong}) {
+		t.Fatalf("Unexpected message received: `%s`", buf[:n])
+	}
+
+	go commandConn.Write([]byte("foo"))
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read(): %s", err)
+	}
+	expected := append([]byte{Output}, base64.StdEncoding.EncodeToString([]byte("foo"))...)
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("Unexpected message received: `%s`", buf[:n])
+	}
+}
+
+func TestConnMasterTruncate(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	writer, reader := NewConnMaster(a), NewConnMaster(b)
+	go func() {
+		writer.Write([]byte("foobar"))
+		writer.Write([]byte("baz"))
+	}()
+
+	buf := make([]byte, 3)
+	for _, expected := range []string{"foo", "baz"} {
+		n, err := reader.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read(): %s", err)
+		}
+		if string(buf[:n]) != expected {
+			t.Fatalf("Unexpected message read: `%s`", buf[:n])
+		}
+	}
+}
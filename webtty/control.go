@@ -0,0 +1,78 @@
+package webtty
+
+import (
+	"context"
+	"log"
+)
+
+// isDataInput and isDataOutput report whether messages of the type
+// carry terminal data, which stay on the master when a control channel is used.
+func isDataInput(messageType byte) bool {
+	return messageType == Input || messageType == InputBase64
+}
+
+func isDataOutput(messageType byte) bool {
+	switch messageType {
+	case Output, CompressedOutput, BinaryOutput:
+		return true
+	}
+	return false
+}
+
+// connFor returns the connection to send a message of the type to,
+// with writeMutex held.
+func (wt *WebTTY) connFor(messageType byte) Master {
+	if wt.control != nil && !isDataOutput(messageType) {
+		return wt.control
+	}
+	return wt.masterConn
+}
+
+// readControl passes messages from the control channel to handleControl
+// until an error occurs, closing controlMessages then.
+// The control channel lasts as long as the WebTTY, even over reattaching,
+// and a message read between runs waits for the next run.
+func (wt *WebTTY) readControl() {
+	buffer := make([]byte, wt.bufferSize)
+	for {
+		n, err := wt.control.Read(buffer)
+		if err != nil {
+			close(wt.controlMessages)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+
+		wt.controlMessages <- append([]byte(nil), buffer[:n]...)
+	}
+}
+
+// handleControl handles messages from the control channel
+// until an error occurs or ctx is canceled when Run returns.
+func (wt *WebTTY) handleControl(ctx context.Context) {
+	for {
+		var data []byte
+		var ok bool
+		select {
+		case data, ok = <-wt.controlMessages:
+		case <-ctx.Done():
+			return
+		}
+		if !ok {
+			wt.reportError(ErrMasterClosed)
+			return
+		}
+
+		if isDataInput(data[0]) {
+			log.Printf("Ignoring data message %s on the control channel (session %s)", MessageType(data[0]), wt.sessionID)
+			continue
+		}
+
+		err := wt.handleMasterReadEvent(data)
+		if err != nil {
+			wt.reportError(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package webtty
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestControlChannel(t *testing.T) {
+	controlOutReader, controlOutWriter := io.Pipe()
+	controlInReader, controlInWriter := io.Pipe()
+	control := pipePair{controlInReader, controlOutWriter}
+
+	ts := newTestSession(t, WithControlChannel(control))
+
+	readControl := func() []byte {
+		buf := make([]byte, 1024)
+		n, err := controlOutReader.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read(): %s", err)
+		}
+		return buf[:n]
+	}
+
+	for {
+		frame := readControl()
+		if frame[0] == SetProtocolInfo {
+			break
+		}
+	}
+
+	controlInWriter.Write([]byte{Ping, 'x'})
+	if frame := readControl(); !bytes.Equal(frame, []byte{Pong, 'x'}) {
+		t.Fatalf("Unexpected message on the control channel: %q", frame)
+	}
+
+	controlInWriter.Write(append([]byte{ResizeTerminal}, `{"columns":80,"rows":24}`...))
+	waitFor(t, func() bool {
+		columns, rows := ts.dt.TerminalSize()
+		return columns == 80 && rows == 24
+	})
+
+	ts.slaveOut.Write([]byte("hello"))
+	if frame := ts.readFrame(t); frame[0] != Output {
+		t.Fatalf("Unexpected message on the master: %q", frame)
+	}
+
+	ts.cancel()
+	if frame := readControl(); frame[0] != ServerClose {
+		t.Fatalf("Unexpected message on the control channel: %q", frame)
+	}
+	<-ts.done
+}
+
+func TestControlChannelBetweenRuns(t *testing.T) {
+	controlOutReader, controlOutWriter := io.Pipe()
+	controlInReader, controlInWriter := io.Pipe()
+	control := pipePair{controlInReader, controlOutWriter}
+
+	ts := newTestSession(t, WithControlChannel(control))
+
+	readControl := func() []byte {
+		buf := make([]byte, 1024)
+		n, err := controlOutReader.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read(): %s", err)
+		}
+		return buf[:n]
+	}
+	readControlInit := func() {
+		for {
+			if frame := readControl(); frame[0] == SetProtocolInfo {
+				return
+			}
+		}
+	}
+
+	readControlInit()
+	ts.cancel()
+	readControl() // ServerClose
+	<-ts.done
+
+	// read while no run is going on, and handled by the next run
+	controlInWriter.Write([]byte{Ping, 'x'})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ts.dt.Run(ctx)
+	}()
+	readControlInit()
+	if frame := readControl(); !bytes.Equal(frame, []byte{Pong, 'x'}) {
+		t.Fatalf("Unexpected message on the control channel: %q", frame)
+	}
+
+	// closing the control channel ends the run
+	controlInWriter.Close()
+	select {
+	case err := <-done:
+		if err != ErrMasterClosed {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		cancel()
+		t.Fatalf("Run() did not return after the control channel is closed")
+	}
+	cancel()
+}
@@ -0,0 +1,59 @@
+package webtty
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Encoding is the encoding of the payload of Output messages,
+// advertised to the master in SetProtocolInfo.
+type Encoding string
+
+const (
+	// EncodingBase64 encodes output in base64, which is the default.
+	EncodingBase64 Encoding = "base64"
+	// EncodingHex encodes output in lowercase hexadecimal,
+	// which is meant for debugging.
+	EncodingHex Encoding = "hex"
+	// EncodingRaw sends output as it is,
+	// which is meant for debugging and interoperability tools.
+	EncodingRaw Encoding = "raw"
+)
+
+// encodedLen returns the length of the encoding of n bytes.
+func (enc Encoding) encodedLen(n int) int {
+	switch enc {
+	case EncodingHex:
+		return hex.EncodedLen(n)
+	case EncodingRaw:
+		return n
+	default:
+		return base64.StdEncoding.EncodedLen(n)
+	}
+}
+
+// encode encodes src into dst, which has encodedLen(len(src)) bytes.
+func (enc Encoding) encode(dst, src []byte) {
+	switch enc {
+	case EncodingHex:
+		hex.Encode(dst, src)
+	case EncodingRaw:
+		copy(dst, src)
+	default:
+		base64.StdEncoding.Encode(dst, src)
+	}
+}
+
+// maxDecodedLen returns the max length of data whose encoding fits in n bytes.
+// Data encoded in base64 is cut at multiples of 3 bytes,
+// so that each encoding is a complete base64 string.
+func (enc Encoding) maxDecodedLen(n int) int {
+	switch enc {
+	case EncodingHex:
+		return n / 2
+	case EncodingRaw:
+		return n
+	default:
+		return n / 4 * 3
+	}
+}
@@ -0,0 +1,64 @@
+package webtty
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestOutputEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		enc      Encoding
+		expected string
+	}{
+		{enc: EncodingBase64, expected: "aGk="},
+		{enc: EncodingHex, expected: "6869"},
+		{enc: EncodingRaw, expected: "hi"},
+	} {
+		t.Run(string(tc.enc), func(t *testing.T) {
+			ts := newTestSession(t, WithOutputEncoding(tc.enc), WithBanner("hi"))
+			defer ts.close(t)
+
+			frames := ts.readInit(t)
+			var info ProtocolInfo
+			err := json.Unmarshal(frames[len(frames)-1][1:], &info)
+			if err != nil {
+				t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+			}
+			if info.OutputEncoding != tc.enc {
+				t.Fatalf("Unexpected output encoding advertised: %s", info.OutputEncoding)
+			}
+
+			frame := ts.readFrame(t)
+			if !bytes.Equal(frame, append([]byte{Output}, tc.expected...)) {
+				t.Fatalf("Unexpected banner message: %q", frame)
+			}
+
+			ts.slaveOut.Write([]byte("hi"))
+			frame = ts.readFrame(t)
+			if !bytes.Equal(frame, append([]byte{Output}, tc.expected...)) {
+				t.Fatalf("Unexpected output message: %q", frame)
+			}
+		})
+	}
+}
+
+func TestOutputEncodingMaxFrameSize(t *testing.T) {
+	ts := newTestSession(t, WithOutputEncoding(EncodingHex), WithMaxFrameSize(65))
+	defer ts.close(t)
+
+	ts.readInit(t)
+	ts.slaveOut.Write(bytes.Repeat([]byte{'x'}, 40))
+	for _, size := range []int{65, 17} {
+		if frame := ts.readFrame(t); len(frame) != size {
+			t.Fatalf("Unexpected message size %d, expected %d", len(frame), size)
+		}
+	}
+}
+
+func TestUnknownOutputEncoding(t *testing.T) {
+	err := WithOutputEncoding("rot13")(&WebTTY{})
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown encoding")
+	}
+}
@@ -2,12 +2,162 @@ package webtty
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
+// DefaultErrorGracePeriod is the default time Run waits for an error of the slave
+// after the master gets closed, see WithErrorGracePeriod.
+const DefaultErrorGracePeriod = 50 * time.Millisecond
+
 var (
 	// ErrSlaveClosed indicates the function has exited by the slave
 	ErrSlaveClosed = errors.New("slave closed")
 
 	// ErrSlaveClosed is returned when the slave connection is closed.
 	ErrMasterClosed = errors.New("master closed")
+
+	// ErrAlreadyStarted is returned when Start is called more than once.
+	ErrAlreadyStarted = errors.New("already started")
+
+	// ErrNotStarted is returned when Wait is called before Start.
+	ErrNotStarted = errors.New("not started")
+
+	// ErrWriteNotPermitted is returned when writing to the slave is not permitted.
+	ErrWriteNotPermitted = errors.New("write not permitted")
+
+	// ErrQuotaExceeded is returned when the byte quota of the session is used up.
+	ErrQuotaExceeded = errors.New("byte quota exceeded")
+
+	// ErrTooManyObservers is returned by AddObserver when no more observers can be attached.
+	ErrTooManyObservers = errors.New("too many observers")
+
+	// ErrObserverNotFound is returned by RemoveObserver for an unknown observer ID.
+	ErrObserverNotFound = errors.New("observer not found")
 )
+
+// ExitError is returned when the slave has exited with an exit status.
+// Its cause is ErrSlaveClosed.
+type ExitError struct {
+	code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("slave exited with status %d", e.code)
+}
+
+// ExitCode returns the exit status of the slave.
+func (e *ExitError) ExitCode() int {
+	return e.code
+}
+
+// Cause returns ErrSlaveClosed.
+func (e *ExitError) Cause() error {
+	return ErrSlaveClosed
+}
+
+// Unwrap returns ErrSlaveClosed.
+func (e *ExitError) Unwrap() error {
+	return ErrSlaveClosed
+}
+
+// MasterError is returned when writing to the master has failed.
+// Its cause is ErrMasterClosed.
+type MasterError struct {
+	// Op is the operation that has failed, such as "write".
+	Op string
+	// Err is the error returned by the master.
+	Err error
+}
+
+func (e *MasterError) Error() string {
+	return fmt.Sprintf("failed to %s master: %s", e.Op, e.Err)
+}
+
+// Cause returns ErrMasterClosed.
+func (e *MasterError) Cause() error {
+	return ErrMasterClosed
+}
+
+// Unwrap returns the error returned by the master.
+func (e *MasterError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrMasterClosed.
+func (e *MasterError) Is(target error) bool {
+	return target == ErrMasterClosed
+}
+
+// SlaveError is returned when writing to the slave has failed.
+// Its cause is ErrSlaveClosed.
+type SlaveError struct {
+	// Op is the operation that has failed, such as "write".
+	Op string
+	// Err is the error returned by the slave.
+	Err error
+}
+
+func (e *SlaveError) Error() string {
+	return fmt.Sprintf("failed to %s slave: %s", e.Op, e.Err)
+}
+
+// Cause returns ErrSlaveClosed.
+func (e *SlaveError) Cause() error {
+	return ErrSlaveClosed
+}
+
+// Unwrap returns the error returned by the slave.
+func (e *SlaveError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrSlaveClosed.
+func (e *SlaveError) Is(target error) bool {
+	return target == ErrSlaveClosed
+}
+
+// ProtocolError is returned when the master has sent a message
+// that can't be handled.
+type ProtocolError struct {
+	// MessageType is the type of the message, or 0 for an empty message.
+	MessageType MessageType
+	// Err describes what is wrong with the message.
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	if e.MessageType == 0 {
+		return fmt.Sprintf("malformed message from master: %s", e.Err)
+	}
+	return fmt.Sprintf("malformed message %s from master: %s", e.MessageType, e.Err)
+}
+
+// Cause returns the error describing what is wrong with the message.
+func (e *ProtocolError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the error describing what is wrong with the message.
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// typedError returns the first MasterError, SlaveError or ProtocolError
+// in the cause chain of err, or nil if there is none.
+// The vendored errors package doesn't implement Unwrap,
+// so the chain is followed with Cause.
+func typedError(err error) error {
+	for err != nil {
+		switch err.(type) {
+		case *MasterError, *SlaveError, *ProtocolError:
+			return err
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return nil
+		}
+		err = cause.Cause()
+	}
+	return nil
+}
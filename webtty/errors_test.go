@@ -0,0 +1,149 @@
+package webtty
+
+import (
+	stderrors "errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runError waits for Run of the session to return an error.
+func (ts *testSession) runError(t *testing.T) error {
+	select {
+	case err := <-ts.done:
+		if err == nil {
+			t.Fatalf("Unexpected nil error from Run()")
+		}
+		return err
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return")
+	}
+	return nil
+}
+
+func TestMasterError(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.cancel()
+
+	ts.readInit(t)
+	ts.masterOut.Close()
+	ts.slaveOut.Write([]byte("hello"))
+
+	err := ts.runError(t)
+	var masterErr *MasterError
+	if !stderrors.As(err, &masterErr) {
+		t.Fatalf("Unexpected error from Run(): %v", err)
+	}
+	if masterErr.Err != io.ErrClosedPipe {
+		t.Errorf("Unexpected underlying error: %v", masterErr.Err)
+	}
+	if errors.Cause(err) != ErrMasterClosed || !stderrors.Is(err, ErrMasterClosed) {
+		t.Errorf("Expected the error to be ErrMasterClosed: %v", err)
+	}
+}
+
+func TestSlaveError(t *testing.T) {
+	ts := newTestSession(t, WithPermitWrite())
+	defer ts.cancel()
+
+	ts.readInit(t)
+	ts.slaveIn.Close()
+	ts.masterIn.Write([]byte{Input, 'l', 's'})
+	ts.readFrame(t) // ServerClose
+
+	err := ts.runError(t)
+	var slaveErr *SlaveError
+	if !stderrors.As(err, &slaveErr) {
+		t.Fatalf("Unexpected error from Run(): %v", err)
+	}
+	if slaveErr.Err != io.ErrClosedPipe {
+		t.Errorf("Unexpected underlying error: %v", slaveErr.Err)
+	}
+	if errors.Cause(err) != ErrSlaveClosed || !stderrors.Is(err, ErrSlaveClosed) {
+		t.Errorf("Expected the error to be ErrSlaveClosed: %v", err)
+	}
+}
+
+func TestSimultaneousErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		grace    time.Duration
+		expected error
+	}{
+		{name: "slave takes precedence", grace: time.Second, expected: ErrSlaveClosed},
+		{name: "no grace period", grace: 0, expected: ErrMasterClosed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+
+			ts := newTestSession(t, WithErrorGracePeriod(tc.grace))
+			defer ts.cancel()
+
+			ts.readInit(t)
+			ts.masterIn.Close()
+			// the slave fails just after the master
+			time.Sleep(50 * time.Millisecond)
+			ts.slaveOut.Close()
+
+			if err := ts.runError(t); err != tc.expected {
+				t.Fatalf("Unexpected error from Run(): %v", err)
+			}
+
+			// both reading goroutines have exited
+			waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+		})
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		message []byte
+	}{
+		{name: "unknown type", message: []byte{'z'}},
+		{name: "malformed resize", message: append([]byte{ResizeTerminal}, "{"...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestSession(t)
+			defer ts.cancel()
+
+			ts.readInit(t)
+			ts.masterIn.Write(tc.message)
+
+			err := ts.runError(t)
+			var protocolErr *ProtocolError
+			if !stderrors.As(err, &protocolErr) {
+				t.Fatalf("Unexpected error from Run(): %v", err)
+			}
+			if protocolErr.MessageType != MessageType(tc.message[0]) {
+				t.Errorf("Unexpected message type `%c`", protocolErr.MessageType)
+			}
+			if protocolErr.Err == nil {
+				t.Errorf("Expected an underlying error")
+			}
+			if !strings.Contains(err.Error(), MessageType(tc.message[0]).String()) {
+				t.Errorf("Expected the message type in the error: %s", err)
+			}
+		})
+	}
+}
+
+func TestProtocolErrorEmptyMessage(t *testing.T) {
+	dt, err := New(pipePair{}, slavePipe{})
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	err = dt.handleMasterReadEvent(nil)
+	var protocolErr *ProtocolError
+	if !stderrors.As(err, &protocolErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if protocolErr.MessageType != 0 {
+		t.Errorf("Unexpected message type `%c`", protocolErr.MessageType)
+	}
+}
@@ -0,0 +1,29 @@
+package webtty
+
+import (
+	"sync"
+)
+
+// framePool holds buffers to build messages written to the master,
+// so that steady output doesn't allocate a buffer for each message.
+var framePool = sync.Pool{
+	New: func() interface{} {
+		frame := make([]byte, 0, 4096)
+		return &frame
+	},
+}
+
+// getFrame returns a buffer of the size from framePool.
+func getFrame(size int) *[]byte {
+	frame := framePool.Get().(*[]byte)
+	if cap(*frame) < size {
+		*frame = make([]byte, size)
+	}
+	*frame = (*frame)[:size]
+	return frame
+}
+
+// putFrame returns a buffer to framePool.
+func putFrame(frame *[]byte) {
+	framePool.Put(frame)
+}
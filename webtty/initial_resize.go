@@ -0,0 +1,75 @@
+package webtty
+
+import (
+	"log"
+	"time"
+)
+
+// startInitialResizeDelay starts the initial resize delay
+// when the session is initialized for the first time.
+func (wt *WebTTY) startInitialResizeDelay() {
+	wt.stateMutex.Lock()
+	defer wt.stateMutex.Unlock()
+
+	if wt.initialResizeTimer != nil || wt.initialResizeDone {
+		return
+	}
+	wt.initialResizeTimer = time.AfterFunc(wt.initialResizeDelay, wt.releaseInitialResize)
+}
+
+// holdInitialResize keeps size as the pending resizing
+// until the initial resize delay ends, and reports whether it's held.
+// Resizing requested again in the delay replaces the pending one.
+func (wt *WebTTY) holdInitialResize(size terminalSize) bool {
+	if wt.initialResizeDelay <= 0 {
+		return false
+	}
+
+	wt.stateMutex.Lock()
+	defer wt.stateMutex.Unlock()
+
+	if wt.initialResizeDone {
+		return false
+	}
+	wt.pendingResize = &size
+	return true
+}
+
+// stopInitialResizeDelay ends the initial resize delay when Run returns,
+// dropping the pending resizing of the master left to the caller.
+func (wt *WebTTY) stopInitialResizeDelay() {
+	wt.stateMutex.Lock()
+	defer wt.stateMutex.Unlock()
+
+	if wt.initialResizeTimer == nil {
+		return
+	}
+	wt.initialResizeTimer.Stop()
+	wt.initialResizeDone = true
+	wt.pendingResize = nil
+}
+
+// releaseInitialResize ends the initial resize delay, when it passes
+// or the slave writes its first output, applying the pending resizing.
+func (wt *WebTTY) releaseInitialResize() {
+	wt.stateMutex.Lock()
+	if wt.initialResizeDone {
+		wt.stateMutex.Unlock()
+		return
+	}
+	wt.initialResizeDone = true
+	if wt.initialResizeTimer != nil {
+		wt.initialResizeTimer.Stop()
+	}
+	pending := wt.pendingResize
+	wt.pendingResize = nil
+	wt.stateMutex.Unlock()
+
+	if pending == nil {
+		return
+	}
+	err := wt.applyResize(*pending)
+	if err != nil {
+		log.Printf("Failed to apply the initial resizing: %s (session %s)", err, wt.sessionID)
+	}
+}
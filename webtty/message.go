@@ -0,0 +1,86 @@
+package webtty
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// maxTerminalSize is the largest number of columns or rows
+// a PTY can accept.
+const maxTerminalSize = 65535
+
+// Message is a unit of the WebTTY protocol.
+// On the wire, a message is its type byte followed by the payload.
+type Message struct {
+	// Type is one of the message type constants
+	Type byte
+	// Payload is the data following the type byte
+	Payload []byte
+}
+
+// DecodeMessage decodes a message received from a stream.
+// The payload shares the underlying array with data.
+func DecodeMessage(data []byte) (Message, error) {
+	if len(data) == 0 {
+		return Message{}, errors.New("empty message")
+	}
+
+	return Message{Type: data[0], Payload: data[1:]}, nil
+}
+
+// EncodeMessage encodes a message to be sent to a stream.
+func EncodeMessage(message Message) []byte {
+	data := make([]byte, 1+len(message.Payload))
+	data[0] = message.Type
+	copy(data[1:], message.Payload)
+	return data
+}
+
+// WindowSize is the payload of SetWindowSize and ResizeAck messages.
+// Zero means the dimension isn't fixed by the server.
+type WindowSize struct {
+	Columns int `json:"columns"`
+	Rows    int `json:"rows"`
+}
+
+type argResizeTerminal struct {
+	Columns float64
+	Rows    float64
+}
+
+type terminalSize struct {
+	columns int
+	rows    int
+}
+
+// clampTerminalSize clamps a number of columns or rows to the valid range.
+func clampTerminalSize(n int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > maxTerminalSize {
+		return maxTerminalSize
+	}
+	return n
+}
+
+// decodeResizeTerminal decodes the payload of a ResizeTerminal message.
+func decodeResizeTerminal(payload []byte) (terminalSize, error) {
+	if len(payload) == 0 {
+		return terminalSize{}, errors.New("received malformed remote command for terminal resize: empty payload")
+	}
+
+	var args argResizeTerminal
+	err := json.Unmarshal(payload, &args)
+	if err != nil {
+		return terminalSize{}, errors.Wrapf(err, "received malformed data for terminal resize")
+	}
+
+	// also rejects NaN
+	if !(args.Columns >= 0 && args.Columns <= maxTerminalSize) || !(args.Rows >= 0 && args.Rows <= maxTerminalSize) {
+		return terminalSize{}, errors.Errorf("received malformed data for terminal resize: out of range size %vx%v", args.Columns, args.Rows)
+	}
+
+	return terminalSize{columns: int(args.Columns), rows: int(args.Rows)}, nil
+}
@@ -0,0 +1,127 @@
+package webtty
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	cases := []struct {
+		data    []byte
+		typ     byte
+		payload []byte
+	}{
+		{[]byte("1hello"), Input, []byte("hello")},
+		{[]byte("2"), Ping, []byte{}},
+		{[]byte(`3{"columns":80,"rows":24}`), ResizeTerminal, []byte(`{"columns":80,"rows":24}`)},
+		{[]byte("0"), UnknownInput, []byte{}},
+	}
+
+	for _, c := range cases {
+		message, err := DecodeMessage(c.data)
+		if err != nil {
+			t.Fatalf("Unexpected error from DecodeMessage(`%s`): %s", c.data, err)
+		}
+		if message.Type != c.typ {
+			t.Errorf("Unexpected message type `%c` for `%s`", message.Type, c.data)
+		}
+		if !bytes.Equal(message.Payload, c.payload) {
+			t.Errorf("Unexpected payload `%s` for `%s`", message.Payload, c.data)
+		}
+	}
+}
+
+func TestDecodeEmptyMessage(t *testing.T) {
+	_, err := DecodeMessage([]byte{})
+	if err == nil {
+		t.Fatalf("Expected an error for an empty message")
+	}
+}
+
+func TestEncodeMessageRoundTrip(t *testing.T) {
+	messages := []Message{
+		{Output, []byte("Zm9vYmFy")},
+		{Pong, nil},
+		{SetWindowTitle, []byte("title")},
+		{SetPreferences, []byte(`{"font-size":14}`)},
+		{SetReconnect, []byte("10")},
+	}
+
+	for _, message := range messages {
+		data := EncodeMessage(message)
+		decoded, err := DecodeMessage(data)
+		if err != nil {
+			t.Fatalf("Unexpected error from DecodeMessage(`%s`): %s", data, err)
+		}
+		if decoded.Type != message.Type || !bytes.Equal(decoded.Payload, message.Payload) {
+			t.Errorf("Message `%s` decoded as `%c%s`", data, decoded.Type, decoded.Payload)
+		}
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte("1hello"))
+	f.Add([]byte("2"))
+	f.Add([]byte(`3{"columns":80,"rows":24}`))
+	f.Add([]byte(`3{"columns":-1,"rows":1e300}`))
+	f.Add([]byte("3"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := DecodeMessage(data)
+		if err != nil {
+			if len(data) != 0 {
+				t.Fatalf("Unexpected error from DecodeMessage(`%s`): %s", data, err)
+			}
+			return
+		}
+		if !bytes.Equal(EncodeMessage(message), data) {
+			t.Fatalf("Message `%s` is not encoded back to itself", data)
+		}
+
+		if message.Type == ResizeTerminal {
+			size, err := decodeResizeTerminal(message.Payload)
+			if err != nil {
+				return
+			}
+			if size.columns < 0 || size.columns > maxTerminalSize || size.rows < 0 || size.rows > maxTerminalSize {
+				t.Fatalf("Out of range size %dx%d decoded from `%s`", size.columns, size.rows, data)
+			}
+		}
+	})
+}
+
+func TestDecodeResizeTerminal(t *testing.T) {
+	size, err := decodeResizeTerminal([]byte(`{"columns":80,"rows":24}`))
+	if err != nil {
+		t.Fatalf("Unexpected error from decodeResizeTerminal(): %s", err)
+	}
+	if size.columns != 80 || size.rows != 24 {
+		t.Fatalf("Unexpected size %dx%d", size.columns, size.rows)
+	}
+
+	for _, payload := range []string{"", "{", `{"columns":-1,"rows":24}`, `{"columns":80,"rows":1e300}`} {
+		_, err := decodeResizeTerminal([]byte(payload))
+		if err == nil {
+			t.Errorf("Expected an error for `%s`", payload)
+		}
+	}
+}
+
+func TestMessageTypeString(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{name: MessageType(Input).String(), expected: "Input"},
+		{name: MessageType(ResizeTerminal).String(), expected: "ResizeTerminal"},
+		{name: MessageType('z').String(), expected: "MessageType('z')"},
+		{name: OutputMessageType(Output).String(), expected: "Output"},
+		{name: OutputMessageType(SetReconnectPolicy).String(), expected: "SetReconnectPolicy"},
+		{name: OutputMessageType('z').String(), expected: "OutputMessageType('z')"},
+	} {
+		if tc.name != tc.expected {
+			t.Errorf("Unexpected name %s, expected %s", tc.name, tc.expected)
+		}
+	}
+}
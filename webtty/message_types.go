@@ -1,5 +1,9 @@
 package webtty
 
+import (
+	"fmt"
+)
+
 // Protocols defines the name of this protocol,
 // which is supposed to be used to the subprotocol of Websockt streams.
 var Protocols = []string{"webtty"}
@@ -9,10 +13,20 @@ const (
 	UnknownInput = '0'
 	// User input typically from a keyboard
 	Input = '1'
-	// Ping to the server
+	// Ping to the server, any payload is echoed back in Pong
 	Ping = '2'
 	// Notify that the browser size has been changed
 	ResizeTerminal = '3'
+	// Acknowledge compressed output advertised by SetCompression
+	AckCompression = '4'
+	// User input encoded in base64, for binary data the transport can't carry
+	InputBase64 = '5'
+	// Tell the protocol version and capabilities of the client,
+	// the payload is a JSON object of ProtocolInfo
+	SetClientInfo = '6'
+	// Request to redraw the terminal, answered by resetting the terminal
+	// and replaying the scrollback when it's enabled
+	RequestRedraw = '7'
 )
 
 const (
@@ -20,7 +34,7 @@ const (
 	UnknownOutput = '0'
 	// Normal output to the terminal
 	Output = '1'
-	// Pong to the browser
+	// Pong to the browser, with the payload of Ping
 	Pong = '2'
 	// Set window title of the terminal
 	SetWindowTitle = '3'
@@ -28,4 +42,108 @@ const (
 	SetPreferences = '4'
 	// Make terminal to reconnect
 	SetReconnect = '5'
+	// Informational message from the server to show to the user,
+	// the payload is a JSON string such as `"maintenance in 5 minutes"`
+	ServerMessage = '6'
+	// Notify that the slave has exited, the payload is its exit status in JSON
+	Exit = '7'
+	// Advertise that the server can compress output,
+	// the payload is the name of the algorithm ("deflate").
+	// The master enables it by replying with AckCompression.
+	SetCompression = '8'
+	// Output compressed with raw deflate and encoded in base64,
+	// each message is a complete deflate stream
+	CompressedOutput = '9'
+	// Set the token to present when reconnecting to the session,
+	// the payload is a JSON string
+	SetReconnectToken = 'a'
+	// Notify that the server is closing the session,
+	// the payload is the reason in a JSON string
+	ServerClose = 'b'
+	// Tell the protocol version and capabilities of the server,
+	// the payload is a JSON object of ProtocolInfo.
+	// The master can reply with SetClientInfo to enable capabilities.
+	SetProtocolInfo = 'c'
+	// Normal output to the terminal without base64 encoding,
+	// sent only to masters with the binary_output capability.
+	// Masters over websocket send it in binary messages,
+	// as the output is not always valid UTF-8
+	BinaryOutput = 'd'
+	// Copy text to the clipboard as requested by the slave with OSC 52,
+	// the payload is the text in a JSON string
+	Clipboard = 'e'
+	// Make terminal to reconnect with exponential backoff,
+	// the payload is a JSON object of ReconnectPolicy.
+	// Legacy clients use the fixed interval of SetReconnect instead
+	SetReconnectPolicy = 'f'
+	// Lock the size of the terminal to the size fixed by the server,
+	// the payload is a JSON object of WindowSize
+	SetWindowSize = 'g'
+	// Acknowledge a ResizeTerminal message with the size applied to the slave,
+	// which can differ from the requested one when the server fixes a dimension.
+	// The payload is a JSON object of WindowSize.
+	// Sent only to masters with the resize_ack capability
+	ResizeAck = 'h'
+	// Configure features of the client such as whether they are enabled,
+	// the payload is a JSON object given by WithClientConfig
+	SetClientConfig = 'i'
 )
+
+// MessageType is the type of a message sent by the master,
+// such as Input. Its String method returns the name of the type.
+// Types of messages sent to the master overlap with them,
+// use OutputMessageType for those.
+type MessageType byte
+
+var messageTypeNames = map[MessageType]string{
+	UnknownInput:   "UnknownInput",
+	Input:          "Input",
+	Ping:           "Ping",
+	ResizeTerminal: "ResizeTerminal",
+	AckCompression: "AckCompression",
+	InputBase64:    "InputBase64",
+	SetClientInfo:  "SetClientInfo",
+	RequestRedraw:  "RequestRedraw",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(%q)", byte(t))
+}
+
+// OutputMessageType is the type of a message sent to the master,
+// such as Output. Its String method returns the name of the type.
+type OutputMessageType byte
+
+var outputMessageTypeNames = map[OutputMessageType]string{
+	UnknownOutput:      "UnknownOutput",
+	Output:             "Output",
+	Pong:               "Pong",
+	SetWindowTitle:     "SetWindowTitle",
+	SetPreferences:     "SetPreferences",
+	SetReconnect:       "SetReconnect",
+	ServerMessage:      "ServerMessage",
+	Exit:               "Exit",
+	SetCompression:     "SetCompression",
+	CompressedOutput:   "CompressedOutput",
+	SetReconnectToken:  "SetReconnectToken",
+	ServerClose:        "ServerClose",
+	SetProtocolInfo:    "SetProtocolInfo",
+	BinaryOutput:       "BinaryOutput",
+	Clipboard:          "Clipboard",
+	SetReconnectPolicy: "SetReconnectPolicy",
+	SetWindowSize:      "SetWindowSize",
+	ResizeAck:          "ResizeAck",
+	SetClientConfig:    "SetClientConfig",
+}
+
+func (t OutputMessageType) String() string {
+	if name, ok := outputMessageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("OutputMessageType(%q)", byte(t))
+}
+
+const compressionDeflate = "deflate"
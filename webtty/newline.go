@@ -0,0 +1,45 @@
+package webtty
+
+// NewlineMode tells how newlines in input from the master
+// are written to the slave.
+type NewlineMode int
+
+const (
+	// NewlinePassthrough writes newlines as they are received.
+	NewlinePassthrough NewlineMode = iota
+	// NewlineCR writes any newline as CR.
+	NewlineCR
+	// NewlineLF writes any newline as LF.
+	NewlineLF
+)
+
+// normalizeNewlines rewrites CR, LF and CRLF in data to the newline of mode.
+// A CRLF split across two inputs is handled using pendingCR,
+// which tells whether the previous input ended with CR.
+func normalizeNewlines(data []byte, mode NewlineMode, pendingCR *bool) []byte {
+	if mode == NewlinePassthrough {
+		return data
+	}
+
+	newline := byte('\r')
+	if mode == NewlineLF {
+		newline = '\n'
+	}
+
+	normalized := make([]byte, 0, len(data))
+	for _, b := range data {
+		switch {
+		case b == '\n' && *pendingCR:
+			// the second half of CRLF
+			*pendingCR = false
+		case b == '\r' || b == '\n':
+			normalized = append(normalized, newline)
+			*pendingCR = b == '\r'
+		default:
+			normalized = append(normalized, b)
+			*pendingCR = false
+		}
+	}
+
+	return normalized
+}
@@ -0,0 +1,225 @@
+package webtty
+
+import (
+	"encoding/base64"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// observerQueueSize is the number of messages queued for an observer.
+// Observers that fall behind by more messages are dropped.
+const observerQueueSize = 256
+
+// observer is a read-only master attached to a WebTTY.
+// Messages are queued and written by a goroutine of each observer,
+// so that a slow observer can't block the session.
+type observer struct {
+	master     Master
+	id         string
+	attachedAt time.Time
+
+	queue    chan []byte
+	done     chan struct{} // closed when the observer is removed
+	doneOnce sync.Once
+}
+
+// stop makes the goroutine writing to the observer exit.
+func (o *observer) stop() {
+	o.doneOnce.Do(func() { close(o.done) })
+}
+
+// ObserverInfo describes an observer attached to a WebTTY.
+type ObserverInfo struct {
+	// ID identifies the observer in RemoveObserver
+	ID string
+	// AttachedAt is the time when the observer was attached
+	AttachedAt time.Time
+}
+
+// AddObserver attaches a read-only master to the session.
+// Observers receive the same messages as the master, except replies
+// to the master such as Pong, and their input is always discarded.
+// Observers that fail to receive a message or fall behind are dropped.
+// Returns ErrTooManyObservers when the limit set by WithMaxObservers is reached.
+func (wt *WebTTY) AddObserver(m Master) error {
+	if wt.observersFull() {
+		return ErrTooManyObservers
+	}
+
+	messages, err := wt.initializeMessages(false)
+	if err != nil {
+		return err
+	}
+
+	id, err := generateSessionID()
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate observer ID")
+	}
+	o := &observer{
+		master:     m,
+		id:         id,
+		attachedAt: time.Now(),
+		queue:      make(chan []byte, observerQueueSize),
+		done:       make(chan struct{}),
+	}
+
+	// written without the lock not to block broadcasting to other observers
+	for _, message := range messages {
+		_, err := wt.writeToMaster(m, EncodeMessage(message))
+		if err != nil {
+			return errors.Wrapf(err, "failed to send initializing message to observer")
+		}
+	}
+
+	wt.observerMutex.Lock()
+	defer wt.observerMutex.Unlock()
+
+	if wt.maxObservers > 0 && len(wt.observers) >= wt.maxObservers {
+		return ErrTooManyObservers
+	}
+	wt.observers = append(wt.observers, o)
+
+	go wt.readObserver(o)
+	go wt.writeObserver(o)
+
+	return nil
+}
+
+func (wt *WebTTY) observersFull() bool {
+	wt.observerMutex.Lock()
+	defer wt.observerMutex.Unlock()
+	return wt.maxObservers > 0 && len(wt.observers) >= wt.maxObservers
+}
+
+// readObserver discards input from an observer until it gets closed.
+func (wt *WebTTY) readObserver(o *observer) {
+	buffer := make([]byte, wt.bufferSize)
+	for {
+		_, err := o.master.Read(buffer)
+		if err != nil {
+			wt.removeObserver(o)
+			return
+		}
+	}
+}
+
+// writeObserver writes queued messages to an observer until it's removed.
+// The observer is dropped when a write fails.
+func (wt *WebTTY) writeObserver(o *observer) {
+	for {
+		select {
+		case frame := <-o.queue:
+			_, err := wt.writeToMaster(o.master, frame)
+			if err != nil {
+				wt.removeObserver(o)
+				return
+			}
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// Observers returns the observers attached to the session.
+func (wt *WebTTY) Observers() []ObserverInfo {
+	wt.observerMutex.Lock()
+	defer wt.observerMutex.Unlock()
+
+	infos := make([]ObserverInfo, 0, len(wt.observers))
+	for _, o := range wt.observers {
+		infos = append(infos, ObserverInfo{ID: o.id, AttachedAt: o.attachedAt})
+	}
+	return infos
+}
+
+// RemoveObserver detaches the observer with the ID from the session.
+// The observer gets no more messages, but closing it is caller's responsibility.
+// Returns ErrObserverNotFound when no observer has the ID.
+func (wt *WebTTY) RemoveObserver(id string) error {
+	wt.observerMutex.Lock()
+	defer wt.observerMutex.Unlock()
+
+	for i, attached := range wt.observers {
+		if attached.id == id {
+			wt.observers = append(wt.observers[:i], wt.observers[i+1:]...)
+			attached.stop()
+			return nil
+		}
+	}
+
+	return ErrObserverNotFound
+}
+
+func (wt *WebTTY) removeObserver(o *observer) bool {
+	wt.observerMutex.Lock()
+	defer wt.observerMutex.Unlock()
+
+	for i, attached := range wt.observers {
+		if attached == o {
+			wt.observers = append(wt.observers[:i], wt.observers[i+1:]...)
+			o.stop()
+			return true
+		}
+	}
+
+	return false
+}
+
+// broadcastFrame queues an encoded message for all observers.
+func (wt *WebTTY) broadcastFrame(frame []byte) {
+	wt.observerMutex.Lock()
+	defer wt.observerMutex.Unlock()
+
+	wt.broadcastFrameLocked(frame)
+}
+
+// broadcastFrameLocked queues a copy of frame, which can be in a reused buffer,
+// with observerMutex held. Observers with a full queue are dropped.
+func (wt *WebTTY) broadcastFrameLocked(frame []byte) {
+	if len(wt.observers) == 0 {
+		return
+	}
+
+	queued := append([]byte(nil), frame...)
+	alive := wt.observers[:0]
+	for _, o := range wt.observers {
+		select {
+		case o.queue <- queued:
+			alive = append(alive, o)
+		default:
+			log.Printf("Dropping observer %s falling behind (session %s)", o.id, wt.sessionID)
+			o.stop()
+		}
+	}
+	for i := len(alive); i < len(wt.observers); i++ {
+		wt.observers[i] = nil
+	}
+	wt.observers = alive
+}
+
+// broadcastOutput sends output of the slave to all observers.
+// frame is the message sent to the master, which is used as is
+// unless it's compressed or binary, as observers don't negotiate them.
+func (wt *WebTTY) broadcastOutput(data []byte, frame []byte) {
+	wt.observerMutex.Lock()
+	defer wt.observerMutex.Unlock()
+
+	if len(wt.observers) == 0 {
+		return
+	}
+
+	// observers don't get SetProtocolInfo to learn other encodings
+	if frame[0] == Output && wt.outputEncoding == EncodingBase64 {
+		wt.broadcastFrameLocked(frame)
+		return
+	}
+
+	plain := getFrame(1 + base64.StdEncoding.EncodedLen(len(data)))
+	(*plain)[0] = Output
+	base64.StdEncoding.Encode((*plain)[1:], data)
+	wt.broadcastFrameLocked(*plain)
+	putFrame(plain)
+}
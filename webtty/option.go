@@ -2,6 +2,9 @@ package webtty
 
 import (
 	"encoding/json"
+	"io"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -17,7 +20,17 @@ func WithPermitWrite() Option {
 	}
 }
 
-// WithFixedColumns sets a fixed width to TTY master.
+// WithSessionID sets the identifier of the session.
+// When not given, a random UUID is generated by New.
+func WithSessionID(id string) Option {
+	return func(wt *WebTTY) error {
+		wt.sessionID = id
+		return nil
+	}
+}
+
+// WithFixedColumns sets a fixed width to TTY master,
+// which is sent to the master in SetWindowSize.
 func WithFixedColumns(columns int) Option {
 	return func(wt *WebTTY) error {
 		wt.columns = columns
@@ -25,7 +38,8 @@ func WithFixedColumns(columns int) Option {
 	}
 }
 
-// WithFixedRows sets a fixed height to TTY master.
+// WithFixedRows sets a fixed height to TTY master,
+// which is sent to the master in SetWindowSize.
 func WithFixedRows(rows int) Option {
 	return func(wt *WebTTY) error {
 		wt.rows = rows
@@ -33,23 +47,52 @@ func WithFixedRows(rows int) Option {
 	}
 }
 
-// WithWindowTitle sets the default window title of the session
+// WithWindowTitle sets the default window title of the session.
+// Control characters are removed and titles longer than 1024 bytes are truncated.
 func WithWindowTitle(windowTitle []byte) Option {
 	return func(wt *WebTTY) error {
-		wt.windowTitle = windowTitle
+		wt.windowTitle = sanitizeTitle(windowTitle)
 		return nil
 	}
 }
 
+// MaxReconnect is the longest reconnect time accepted by WithReconnect,
+// a day in seconds.
+const MaxReconnect = 24 * 60 * 60
+
 // WithReconnect enables reconnection on the master side.
+// Zero disables reconnection. Negative times and times longer than
+// MaxReconnect are rejected.
 func WithReconnect(timeInSeconds int) Option {
 	return func(wt *WebTTY) error {
+		if timeInSeconds < 0 || timeInSeconds > MaxReconnect {
+			return errors.Errorf("reconnect time out of range: %d seconds", timeInSeconds)
+		}
 		wt.reconnect = timeInSeconds
 		return nil
 	}
 }
 
+// WithReconnectBackoff makes the master back off reconnection attempts,
+// starting with base and multiplying the delay by multiplier after each
+// failure up to max. Use it with WithReconnect for clients that don't
+// support backoff.
+// Negative delays, base longer than max and multipliers less than 1 are rejected.
+func WithReconnectBackoff(base, max time.Duration, multiplier float64) Option {
+	return func(wt *WebTTY) error {
+		if base < 0 || base > max {
+			return errors.Errorf("reconnect backoff out of range: base %s, max %s", base, max)
+		}
+		if multiplier < 1 {
+			return errors.Errorf("reconnect backoff multiplier less than 1: %g", multiplier)
+		}
+		wt.reconnectPolicy = newReconnectPolicy(base, max, multiplier)
+		return nil
+	}
+}
+
 // WithMasterPreferences sets an optional configuration of master.
+// It takes precedence over WithPreferences.
 func WithMasterPreferences(preferences interface{}) Option {
 	return func(wt *WebTTY) error {
 		prefs, err := json.Marshal(preferences)
@@ -60,3 +103,438 @@ func WithMasterPreferences(preferences interface{}) Option {
 		return nil
 	}
 }
+
+// WithClientConfig sets flags of features for the client to configure itself,
+// such as whether reconnecting is enabled.
+// They are sent to the master in a SetClientConfig message on connect.
+func WithClientConfig(config map[string]interface{}) Option {
+	return func(wt *WebTTY) error {
+		data, err := json.Marshal(config)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal client config as JSON")
+		}
+		wt.clientConfig = data
+		return nil
+	}
+}
+
+// WithPreferences sets typed preferences of master.
+// Zero fields are filled from DefaultPreferences.
+// Preferences given by WithMasterPreferences take precedence and
+// aren't merged with them.
+func WithPreferences(preferences Preferences) Option {
+	return func(wt *WebTTY) error {
+		wt.preferences = &preferences
+		return nil
+	}
+}
+
+// WithMetricsObserver sets an observer notified of traffic events.
+func WithMetricsObserver(obs MetricsObserver) Option {
+	return func(wt *WebTTY) error {
+		wt.metrics = obs
+		return nil
+	}
+}
+
+// WithDrainTimeout makes Run keep forwarding output from the slave
+// after the context is canceled, so that the last output of the slave
+// can reach the master. Run returns once the output stops,
+// and waits d at most for a slave writing output continuously.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(wt *WebTTY) error {
+		wt.drainTimeout = d
+		return nil
+	}
+}
+
+// WithErrorGracePeriod sets how long Run waits for an error of the slave
+// after the master gets closed, so that the error of the slave is returned
+// when both ends fail at nearly the same time.
+// DefaultErrorGracePeriod is used by default, zero disables waiting.
+func WithErrorGracePeriod(d time.Duration) Option {
+	return func(wt *WebTTY) error {
+		wt.errorGracePeriod = d
+		return nil
+	}
+}
+
+// WithIgnoreUnknownMessages makes a WebTTY skip messages of unknown types
+// from the master instead of returning an error,
+// so that newer clients can connect to older servers.
+func WithIgnoreUnknownMessages() Option {
+	return func(wt *WebTTY) error {
+		wt.ignoreUnknownMessages = true
+		return nil
+	}
+}
+
+// WithCompression advertises compressed output to the master.
+// Output is compressed once the master acknowledges it,
+// and sent uncompressed until then.
+func WithCompression() Option {
+	return func(wt *WebTTY) error {
+		wt.compression = &compressor{}
+		return nil
+	}
+}
+
+// WithOutputCoalesce makes a WebTTY accumulate small chunks of output
+// from the slave and send them in one message, when maxBytes are queued
+// or maxDelay has passed since the first queued chunk.
+// Zero values use DefaultCoalesceDelay and DefaultCoalesceBytes.
+func WithOutputCoalesce(maxDelay time.Duration, maxBytes int) Option {
+	return func(wt *WebTTY) error {
+		if maxDelay <= 0 {
+			maxDelay = DefaultCoalesceDelay
+		}
+		if maxBytes <= 0 {
+			maxBytes = DefaultCoalesceBytes
+		}
+		wt.coalescer = &coalescer{maxDelay: maxDelay, maxBytes: maxBytes}
+		return nil
+	}
+}
+
+// WithWriteQueueDepth makes a WebTTY write output to the master in
+// a dedicated goroutine, with a queue of up to n chunks read from the slave.
+// When the master can't keep up and the queue is full,
+// reading the slave pauses until the queue has room.
+func WithWriteQueueDepth(n int) Option {
+	return func(wt *WebTTY) error {
+		wt.writeQueueDepth = n
+		return nil
+	}
+}
+
+// WithInitialInput sets input written to the slave when the session starts,
+// e.g. a command to run automatically.
+// It's written only once even when Run is called again,
+// and only when writing is permitted.
+func WithInitialInput(input []byte) Option {
+	return func(wt *WebTTY) error {
+		wt.initialInput = input
+		return nil
+	}
+}
+
+// WithScrollback makes a WebTTY keep the last size bytes of output
+// from the slave, which are replayed to a master attached by Reattach.
+func WithScrollback(size int) Option {
+	return func(wt *WebTTY) error {
+		if size > 0 {
+			wt.scrollback = newScrollback(size)
+		}
+		return nil
+	}
+}
+
+// WithCompressedScrollback works like WithScrollback, but keeps the output
+// compressed with deflate, and decompresses it when it's replayed.
+// It saves memory for a large scrollback of text at the cost of CPU time.
+func WithCompressedScrollback(size int) Option {
+	return func(wt *WebTTY) error {
+		if size > 0 {
+			wt.scrollback = newCompressedScrollback(size)
+		}
+		return nil
+	}
+}
+
+// WithReattach makes a session survive losing its master.
+// A reconnect token is sent to the master, and when the master gets
+// closed, Run waits for another master given to Reattach instead of
+// returning ErrMasterClosed. Run gives up after timeout,
+// or waits until the context is canceled when timeout is zero.
+func WithReattach(timeout time.Duration) Option {
+	return func(wt *WebTTY) error {
+		wt.reattach = true
+		wt.reattachTimeout = timeout
+		return nil
+	}
+}
+
+// WithPauseBufferSize sets the maximum size of output kept while paused.
+func WithPauseBufferSize(size int) Option {
+	return func(wt *WebTTY) error {
+		if size > 0 {
+			wt.pauseBufferSize = size
+		}
+		return nil
+	}
+}
+
+// WithBanner sets a text shown to the master before any output of the slave.
+// The text can contain escape sequences such as ANSI colors.
+// Line feeds in the text are sent as CRLF.
+func WithBanner(text string) Option {
+	return func(wt *WebTTY) error {
+		text = strings.Replace(text, "\r\n", "\n", -1)
+		text = strings.Replace(text, "\n", "\r\n", -1)
+		wt.banner = []byte(text)
+		return nil
+	}
+}
+
+// WithRespawn replaces the slave with a new one created by factory
+// when the slave gets closed, instead of returning ErrSlaveClosed.
+// The master receives the initializing messages again after each respawn.
+// Up to max slaves are respawned, or any number when max is zero.
+func WithRespawn(factory SlaveFactory, max int) Option {
+	return func(wt *WebTTY) error {
+		wt.respawnFactory = factory
+		wt.respawnMax = max
+		return nil
+	}
+}
+
+// WithRespawnDelay sets the delay before respawning a closed slave.
+func WithRespawnDelay(delay time.Duration) Option {
+	return func(wt *WebTTY) error {
+		wt.respawnDelay = delay
+		return nil
+	}
+}
+
+// WithTransformPipeline appends transforms applied in order to data going
+// in the direction, DirectionToMaster for output of the slave
+// and DirectionToSlave for input from the master.
+// Output is transformed before anything else handles it, such as the output tee,
+// and input before its newlines are rewritten.
+// Transforms are called from the goroutine reading the slave or the master,
+// and input transforms also from InjectInput and Interrupt.
+func WithTransformPipeline(direction string, transforms ...Transform) Option {
+	return func(wt *WebTTY) error {
+		switch direction {
+		case DirectionToMaster:
+			wt.outputTransforms = append(wt.outputTransforms, transforms...)
+		case DirectionToSlave:
+			wt.inputTransforms = append(wt.inputTransforms, transforms...)
+		default:
+			return errors.Errorf("unknown direction of transforms `%s`", direction)
+		}
+		return nil
+	}
+}
+
+// WithInitialResizeDelay holds the first ResizeTerminal from the master
+// until d passes after the session is initialized or the slave writes
+// its first output, whichever comes first, as resizing before the shell
+// draws its first prompt can break the layout on some terminals.
+// Other messages from the master are handled meanwhile, and resizing
+// requested again in the delay replaces the held one.
+// Later resizing is applied immediately.
+func WithInitialResizeDelay(d time.Duration) Option {
+	return func(wt *WebTTY) error {
+		wt.initialResizeDelay = d
+		return nil
+	}
+}
+
+// WithInputNewline rewrites newlines in input from the master before
+// writing it to the slave. NewlinePassthrough is used by default.
+func WithInputNewline(mode NewlineMode) Option {
+	return func(wt *WebTTY) error {
+		wt.inputNewline = mode
+		return nil
+	}
+}
+
+// WithByteQuota limits the bytes transferred in both directions of the session.
+// Run returns ErrQuotaExceeded once more than n bytes are transferred.
+// Zero means unlimited.
+func WithByteQuota(n int64) Option {
+	return func(wt *WebTTY) error {
+		wt.byteQuota = n
+		return nil
+	}
+}
+
+// WithOnBell sets a function called for each BEL in output of the slave,
+// except BEL terminating OSC sequences such as setting the window title.
+// The function is called from the goroutine reading the slave,
+// so it should return quickly. BEL is still sent to the master.
+func WithOnBell(f func()) Option {
+	return func(wt *WebTTY) error {
+		wt.onBell = f
+		wt.osc = &oscParser{}
+		return nil
+	}
+}
+
+// WithClipboardPassthrough sends text that the slave copies to the clipboard
+// with OSC 52 to the master in Clipboard messages.
+// As any program in the terminal can set the clipboard of the user with it,
+// it's disabled by default.
+func WithClipboardPassthrough() Option {
+	return func(wt *WebTTY) error {
+		wt.clipboardPassthrough = true
+		wt.osc = &oscParser{}
+		return nil
+	}
+}
+
+// WithDynamicTitle sets the window title to titles that the slave sets
+// with OSC 0 and OSC 2, e.g. a shell showing the current directory.
+// The sequences are still sent to the master as output.
+func WithDynamicTitle() Option {
+	return func(wt *WebTTY) error {
+		wt.dynamicTitle = true
+		wt.osc = &oscParser{}
+		return nil
+	}
+}
+
+// WithOutputTee writes raw output of the slave to w as well as the master.
+// An error from w is logged and stops writing to w, but not the session.
+func WithOutputTee(w io.Writer) Option {
+	return func(wt *WebTTY) error {
+		wt.outputTee = w
+		return nil
+	}
+}
+
+// WithWriteTimeout limits the time to write a message to the master,
+// so that a stuck master can't block the session.
+// When a write takes longer, the master is considered closed.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(wt *WebTTY) error {
+		wt.writeTimeout = timeout
+		return nil
+	}
+}
+
+// WithSlaveWriteTimeout limits the time to write input to the slave,
+// so that a stuck slave can't block handling messages from the master.
+// When a write takes longer, the slave is considered closed
+// and the session ends.
+func WithSlaveWriteTimeout(timeout time.Duration) Option {
+	return func(wt *WebTTY) error {
+		wt.slaveWriteTimeout = timeout
+		return nil
+	}
+}
+
+// WithOutputRateLimit limits the rate of output of the slave sent to the master.
+// Reading the slave is paused to keep the rate, so the slave gets blocked
+// instead of overwhelming the master.
+func WithOutputRateLimit(bytesPerSec int) Option {
+	return func(wt *WebTTY) error {
+		if bytesPerSec > 0 {
+			wt.rateLimiter = &rateLimiter{bytesPerSec: bytesPerSec}
+		}
+		return nil
+	}
+}
+
+// WithOutputOnly disables input completely for display only sessions.
+// Input from the master is dropped even with WithPermitWrite or SetPermitWrite,
+// and the master is told to hide its input in SetProtocolInfo.
+// Resizing is still honored unless the size is fixed.
+func WithOutputOnly() Option {
+	return func(wt *WebTTY) error {
+		wt.outputOnly = true
+		return nil
+	}
+}
+
+// minMaxFrameSize is the smallest max frame size accepted by WithMaxFrameSize.
+const minMaxFrameSize = 64
+
+// WithMaxFrameSize limits the size of output messages sent to the master.
+// Output longer than the limit is split into multiple messages.
+// Sizes under 64 bytes are raised to 64 bytes.
+func WithMaxFrameSize(n int) Option {
+	return func(wt *WebTTY) error {
+		if n > 0 && n < minMaxFrameSize {
+			n = minMaxFrameSize
+		}
+		wt.maxFrameSize = n
+		return nil
+	}
+}
+
+// WithControlChannel sends and receives control messages, such as resizing,
+// pings and preferences, on m instead of the master.
+// The master carries only terminal input and output.
+// This is useful with transports that provide multiple streams.
+func WithControlChannel(m Master) Option {
+	return func(wt *WebTTY) error {
+		wt.control = m
+		return nil
+	}
+}
+
+// WithOnClose sets a function called once each time Run returns,
+// with the error returned by Run, or nil when the context was canceled.
+// It's useful to release resources bound to the session.
+func WithOnClose(f func(err error)) Option {
+	return func(wt *WebTTY) error {
+		wt.onClose = f
+		return nil
+	}
+}
+
+// WithOutputEncoding sets the encoding of the payload of Output messages,
+// which is advertised to the master in SetProtocolInfo.
+// The default is EncodingBase64. Other encodings are meant for debugging.
+// Output is still sent in BinaryOutput and CompressedOutput messages
+// when they are negotiated.
+func WithOutputEncoding(enc Encoding) Option {
+	return func(wt *WebTTY) error {
+		switch enc {
+		case EncodingBase64, EncodingHex, EncodingRaw:
+			wt.outputEncoding = enc
+			return nil
+		}
+		return errors.Errorf("unknown output encoding `%s`", enc)
+	}
+}
+
+// WithFrameObserver sets a function called with each message written to
+// the master, with DirectionToMaster, and each message received from the
+// master, with DirectionFromMaster, to trace the protocol.
+// OutputMessageType and MessageType give the names of their types.
+// The function gets a copy of the message and is called
+// from the goroutines handling the messages, so it should return quickly.
+func WithFrameObserver(f func(direction string, frame []byte)) Option {
+	return func(wt *WebTTY) error {
+		wt.frameObserver = f
+		return nil
+	}
+}
+
+// WithProtocolTrace writes a line to w for each message written to and
+// received from the master, with the time, the direction, the name of the type
+// and the length of the payload, such as
+// `2006-01-02T15:04:05.000000Z from_master Ping 0`.
+// Payloads are not written. The format is stable, so that client authors
+// can compare traces of their clients with the expected ones.
+// Errors writing to w are ignored.
+func WithProtocolTrace(w io.Writer) Option {
+	return func(wt *WebTTY) error {
+		wt.trace = &protocolTrace{w: w}
+		return nil
+	}
+}
+
+// WithMaxObservers limits the number of observers attached at the same time.
+// Observers that are closed or dropped free their slots.
+func WithMaxObservers(n int) Option {
+	return func(wt *WebTTY) error {
+		wt.maxObservers = n
+		return nil
+	}
+}
+
+// WithAnswerSizeQueries answers queries of the terminal size from the slave,
+// `CSI 18 t` and `CSI 6 n`, with the last size the terminal was resized to.
+// The cursor position is always reported at the bottom right corner,
+// so it's meant for masters that don't answer the queries themselves and
+// programs that use them only to learn the size.
+func WithAnswerSizeQueries() Option {
+	return func(wt *WebTTY) error {
+		wt.sizeQueries = &sizeQueryParser{}
+		return nil
+	}
+}
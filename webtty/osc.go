@@ -0,0 +1,139 @@
+package webtty
+
+import (
+	"bytes"
+)
+
+// maxOSCSize is the maximum size of an OSC sequence kept by oscParser,
+// longer sequences are discarded.
+const maxOSCSize = 1024 * 1024
+
+const (
+	oscGround       = iota
+	oscEscape       // got ESC
+	oscString       // in the string of an OSC sequence
+	oscStringEscape // got ESC in the string, maybe ST
+)
+
+// oscParser finds operating system command (OSC) sequences
+// such as `ESC ] 52 ; c ; Zm9v BEL` in output of the slave.
+// The 8-bit forms of OSC (0x9D) and ST (0x9C) are also recognized
+// unless they are continuation bytes of UTF-8 characters.
+// Sequences split across reads are handled by keeping the state.
+type oscParser struct {
+	state    int
+	buffer   []byte
+	overflow bool
+	// continuation bytes expected for the current UTF-8 character
+	utf8Remaining int
+}
+
+// parse feeds data to the parser, calling f with the string of
+// each complete OSC sequence, e.g. `52;c;Zm9v`,
+// and bell for each BEL not terminating an OSC sequence when it's not nil.
+func (p *oscParser) parse(data []byte, f func(osc []byte), bell func()) {
+	for _, b := range data {
+		continuation := p.utf8Remaining > 0 && b&0xc0 == 0x80
+		if continuation {
+			p.utf8Remaining--
+		} else {
+			p.utf8Remaining = utf8Continuations(b)
+		}
+
+		switch p.state {
+		case oscGround:
+			if b == 0x1b {
+				p.state = oscEscape
+			} else if b == 0x9d && !continuation {
+				p.start()
+			} else if b == '\a' && bell != nil {
+				bell()
+			}
+
+		case oscEscape:
+			if b == ']' {
+				p.start()
+			} else if b != 0x1b {
+				p.state = oscGround
+				if b == '\a' && bell != nil {
+					bell()
+				}
+			}
+
+		case oscString:
+			switch {
+			case b == '\a' || (b == 0x9c && !continuation):
+				p.finish(f)
+			case b == 0x1b:
+				p.state = oscStringEscape
+			default:
+				p.append(b)
+			}
+
+		case oscStringEscape:
+			if b == '\\' {
+				p.finish(f)
+			} else if b == ']' {
+				// another OSC sequence aborting this one
+				p.start()
+			} else {
+				p.state = oscGround
+			}
+		}
+	}
+}
+
+// utf8Continuations returns the number of continuation bytes
+// following b when it's the first byte of a UTF-8 character.
+func utf8Continuations(b byte) int {
+	switch {
+	case b&0xe0 == 0xc0:
+		return 1
+	case b&0xf0 == 0xe0:
+		return 2
+	case b&0xf8 == 0xf0:
+		return 3
+	}
+	return 0
+}
+
+func (p *oscParser) start() {
+	p.state = oscString
+	p.buffer = p.buffer[:0]
+	p.overflow = false
+}
+
+func (p *oscParser) append(b byte) {
+	if len(p.buffer) >= maxOSCSize {
+		p.overflow = true
+		return
+	}
+	p.buffer = append(p.buffer, b)
+}
+
+func (p *oscParser) finish(f func(osc []byte)) {
+	p.state = oscGround
+	if !p.overflow {
+		f(p.buffer)
+	}
+	p.buffer = p.buffer[:0]
+}
+
+// handleOSC handles OSC sequences in output of the slave
+// for the enabled features, and calls the bell function for BEL
+// outside of them.
+func (wt *WebTTY) handleOSC(data []byte) error {
+	var err error
+	wt.osc.parse(data, func(osc []byte) {
+		if err != nil {
+			return
+		}
+		switch {
+		case wt.clipboardPassthrough && bytes.HasPrefix(osc, oscClipboard):
+			err = wt.forwardClipboard(osc[len(oscClipboard):])
+		case wt.dynamicTitle && (bytes.HasPrefix(osc, oscTitle) || bytes.HasPrefix(osc, oscIconAndTitle)):
+			err = wt.SetWindowTitle(string(osc[bytes.IndexByte(osc, ';')+1:]))
+		}
+	}, wt.onBell)
+	return err
+}
@@ -0,0 +1,62 @@
+package webtty
+
+// DefaultPauseBufferSize is the default maximum size of output
+// kept while a session is paused.
+const DefaultPauseBufferSize = 1024 * 1024
+
+// Pause stops sending output of the slave to the master.
+// The slave is still read, and its output is kept until Resume,
+// discarding the oldest bytes over the pause buffer size.
+func (wt *WebTTY) Pause() {
+	wt.pauseMutex.Lock()
+	defer wt.pauseMutex.Unlock()
+
+	if wt.pauseBuffer == nil {
+		wt.pauseBuffer = newScrollback(wt.pauseBufferSize)
+	}
+	wt.paused = true
+}
+
+// Resume sends the output kept while paused to the master in order,
+// and restarts sending output.
+func (wt *WebTTY) Resume() error {
+	wt.pauseMutex.Lock()
+	defer wt.pauseMutex.Unlock()
+
+	if !wt.paused {
+		return nil
+	}
+	wt.paused = false
+
+	data := wt.pauseBuffer.Bytes()
+	wt.pauseBuffer = nil
+
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > replayChunkSize {
+			chunk = chunk[:replayChunkSize]
+		}
+		data = data[len(chunk):]
+
+		err := wt.sendOutput(chunk)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keepIfPaused keeps output while the session is paused,
+// and reports whether it's kept.
+func (wt *WebTTY) keepIfPaused(data []byte) bool {
+	wt.pauseMutex.Lock()
+	defer wt.pauseMutex.Unlock()
+
+	if !wt.paused {
+		return false
+	}
+
+	wt.pauseBuffer.Write(data)
+	return true
+}
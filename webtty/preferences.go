@@ -0,0 +1,64 @@
+package webtty
+
+// Preferences is a typed set of terminal preferences sent to the master
+// in a SetPreferences message.
+// Keys follow the preference names of hterm.
+// Zero fields are filled from DefaultPreferences before sending,
+// and the fields still zero are omitted so that the master keeps
+// its own defaults for them.
+// False booleans are omitted as well, so they can't turn off what hterm
+// enables by default, such as scrollbar-visible.
+type Preferences struct {
+	// Font family of the terminal, e.g. "monospace"
+	FontFamily string `json:"font-family,omitempty"`
+	// Font size in pixels
+	FontSize int `json:"font-size,omitempty"`
+	// Foreground color as a CSS color value
+	ForegroundColor string `json:"foreground-color,omitempty"`
+	// Background color as a CSS color value
+	BackgroundColor string `json:"background-color,omitempty"`
+	// Cursor color as a CSS color value
+	CursorColor string `json:"cursor-color,omitempty"`
+	// Shape of the cursor, one of "BLOCK", "BEAM" and "UNDERLINE"
+	CursorShape string `json:"cursor-shape,omitempty"`
+	// Makes the cursor blink
+	CursorBlink bool `json:"cursor-blink,omitempty"`
+	// Shows the scrollbar
+	ScrollbarVisible bool `json:"scrollbar-visible,omitempty"`
+}
+
+// DefaultPreferences are sent for the fields that are left zero
+// in preferences given to WithPreferences.
+// Booleans are false by default, as false can't be told from unset.
+var DefaultPreferences = Preferences{
+	FontFamily:  "monospace",
+	FontSize:    15,
+	CursorShape: "BLOCK",
+}
+
+// withDefaults returns the preferences with zero fields
+// filled from DefaultPreferences.
+func (p Preferences) withDefaults() Preferences {
+	d := DefaultPreferences
+	if p.FontFamily == "" {
+		p.FontFamily = d.FontFamily
+	}
+	if p.FontSize == 0 {
+		p.FontSize = d.FontSize
+	}
+	if p.ForegroundColor == "" {
+		p.ForegroundColor = d.ForegroundColor
+	}
+	if p.BackgroundColor == "" {
+		p.BackgroundColor = d.BackgroundColor
+	}
+	if p.CursorColor == "" {
+		p.CursorColor = d.CursorColor
+	}
+	if p.CursorShape == "" {
+		p.CursorShape = d.CursorShape
+	}
+	p.CursorBlink = p.CursorBlink || d.CursorBlink
+	p.ScrollbarVisible = p.ScrollbarVisible || d.ScrollbarVisible
+	return p
+}
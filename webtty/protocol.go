@@ -0,0 +1,87 @@
+package webtty
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// ProtocolVersion is the version of the protocol spoken by this package.
+const ProtocolVersion = 1
+
+const (
+	// CapabilityBinaryOutput is sending output in BinaryOutput messages
+	// without base64 encoding.
+	CapabilityBinaryOutput = "binary_output"
+	// CapabilityInputBase64 is accepting input in InputBase64 messages.
+	CapabilityInputBase64 = "input_base64"
+	// CapabilityCompression is compressing output, see SetCompression.
+	CapabilityCompression = "compression"
+	// CapabilityResizeAck is acknowledging resizing with ResizeAck messages.
+	CapabilityResizeAck = "resize_ack"
+)
+
+// ProtocolInfo is the payload of SetProtocolInfo and SetClientInfo messages.
+type ProtocolInfo struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	// OutputOnly tells the client to hide its input, sent by the server
+	OutputOnly bool `json:"output_only,omitempty"`
+	// OutputEncoding is the encoding of Output messages, sent by the server
+	OutputEncoding Encoding `json:"output_encoding,omitempty"`
+}
+
+// protocolInfo returns the protocol info of the server side.
+func (wt *WebTTY) protocolInfo() ProtocolInfo {
+	info := ProtocolInfo{
+		Version:        ProtocolVersion,
+		Capabilities:   []string{CapabilityBinaryOutput, CapabilityInputBase64, CapabilityResizeAck},
+		OutputOnly:     wt.outputOnlyMode(),
+		OutputEncoding: wt.outputEncoding,
+	}
+	if wt.compression != nil {
+		info.Capabilities = append(info.Capabilities, CapabilityCompression)
+	}
+	return info
+}
+
+// handleClientInfo enables features supported by the master.
+// Malformed info and unknown versions leave the session on the baseline protocol.
+func (wt *WebTTY) handleClientInfo(payload []byte) {
+	var info ProtocolInfo
+	err := json.Unmarshal(payload, &info)
+	if err != nil {
+		log.Printf("Ignoring malformed client info: %s (session %s)", err, wt.sessionID)
+		return
+	}
+	if info.Version < 1 {
+		log.Printf("Ignoring client info of unknown protocol version %d (session %s)", info.Version, wt.sessionID)
+		return
+	}
+
+	binaryOutput, resizeAck := false, false
+	for _, capability := range info.Capabilities {
+		switch capability {
+		case CapabilityBinaryOutput:
+			binaryOutput = true
+		case CapabilityResizeAck:
+			resizeAck = true
+		}
+	}
+
+	wt.stateMutex.Lock()
+	wt.binaryOutput = binaryOutput
+	wt.resizeAck = resizeAck
+	wt.stateMutex.Unlock()
+}
+
+func (wt *WebTTY) binaryOutputEnabled() bool {
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+	return wt.binaryOutput
+}
+
+func (wt *WebTTY) resizeAckEnabled() bool {
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+	return wt.resizeAck
+}
@@ -0,0 +1,105 @@
+package webtty
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestProtocolInfo(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	frames := ts.readInit(t)
+	frame := frames[len(frames)-1]
+
+	var info ProtocolInfo
+	err := json.Unmarshal(frame[1:], &info)
+	if err != nil {
+		t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+	}
+	if info.Version != ProtocolVersion {
+		t.Fatalf("Unexpected protocol version: %d", info.Version)
+	}
+	expected := []string{CapabilityBinaryOutput, CapabilityInputBase64, CapabilityResizeAck}
+	if len(info.Capabilities) != len(expected) {
+		t.Fatalf("Unexpected capabilities: %v", info.Capabilities)
+	}
+	for i := range expected {
+		if info.Capabilities[i] != expected[i] {
+			t.Fatalf("Unexpected capabilities: %v", info.Capabilities)
+		}
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	testCases := []struct {
+		name       string
+		clientInfo string
+		binary     bool
+	}{
+		{"modern", `{"version":1,"capabilities":["binary_output","foo"]}`, true},
+		{"newer", `{"version":99,"capabilities":["binary_output"]}`, true},
+		{"no capabilities", `{"version":1}`, false},
+		{"unknown version", `{"version":0,"capabilities":["binary_output"]}`, false},
+		{"malformed", `binary_output`, false},
+		{"legacy", ``, false},
+	}
+
+	for _, tc := range testCases {
+		ts := newTestSession(t)
+
+		ts.readInit(t)
+		if tc.clientInfo != "" {
+			ts.masterIn.Write(append([]byte{SetClientInfo}, tc.clientInfo...))
+		}
+		ts.masterIn.Write([]byte{Ping})
+		ts.readFrame(t)
+
+		go ts.slaveOut.Write([]byte("foo\x00bar"))
+		frame := ts.readFrame(t)
+		if tc.binary {
+			if !bytes.Equal(frame, append([]byte{BinaryOutput}, "foo\x00bar"...)) {
+				t.Fatalf("Unexpected message received by %s client: %q", tc.name, frame)
+			}
+		} else {
+			if output := decodeOutput(t, frame); !bytes.Equal(output, []byte("foo\x00bar")) {
+				t.Fatalf("Unexpected output received by %s client: %q", tc.name, output)
+			}
+		}
+
+		ts.close(t)
+	}
+}
+
+func TestOutputOnly(t *testing.T) {
+	var slave recordingSlave
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		slave = newRecordingSlave(sp)
+		return slave
+	}, WithOutputOnly(), WithPermitWrite(), WithInitialInput([]byte("top\n")))
+	defer ts.close(t)
+
+	frames := ts.readInit(t)
+	var info ProtocolInfo
+	err := json.Unmarshal(frames[len(frames)-1][1:], &info)
+	if err != nil {
+		t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+	}
+	if !info.OutputOnly {
+		t.Fatalf("Output only mode not advertised")
+	}
+
+	ts.dt.SetPermitWrite(true)
+	ts.masterIn.Write([]byte{Input, 'l', 's'})
+	ts.masterIn.Write([]byte{InputBase64, 'b', 'H', 'M', '='})
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+
+	if recorded := slave.recorded(); recorded != "" {
+		t.Fatalf("Unexpected input written: `%s`", recorded)
+	}
+	if err := ts.dt.InjectInput([]byte("ls")); err != ErrWriteNotPermitted {
+		t.Fatalf("Unexpected error from InjectInput(): %v", err)
+	}
+}
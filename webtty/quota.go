@@ -0,0 +1,57 @@
+package webtty
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// closeNoticeTimeout is how long Run waits for the close notice
+// to be written when the context is canceled.
+const closeNoticeTimeout = 500 * time.Millisecond
+
+// consumeQuota adds n bytes to the data transferred in the session,
+// and stops Run with ErrQuotaExceeded once the byte quota is crossed.
+func (wt *WebTTY) consumeQuota(n int) {
+	if wt.byteQuota <= 0 || n <= 0 {
+		return
+	}
+
+	used := atomic.AddInt64(&wt.quotaUsed, int64(n))
+	if used > wt.byteQuota && used-int64(n) <= wt.byteQuota {
+		wt.reportError(ErrQuotaExceeded)
+	}
+}
+
+// quotaExceeded reports whether the byte quota is used up,
+// no more data is transferred once it's true.
+func (wt *WebTTY) quotaExceeded() bool {
+	return wt.byteQuota > 0 && atomic.LoadInt64(&wt.quotaUsed) > wt.byteQuota
+}
+
+// sendCloseNotice tells the master the reason why the session is closing.
+// Observers aren't told, as they can be closed apart from the session.
+func (wt *WebTTY) sendCloseNotice(reason string) error {
+	message, _ := json.Marshal(reason)
+	return wt.primaryWrite(Message{ServerClose, message})
+}
+
+// trySendCloseNotice sends the close notice like sendCloseNotice,
+// but gives up waiting after closeNoticeTimeout,
+// so that a blocked write to the master can't keep Run from returning.
+func (wt *WebTTY) trySendCloseNotice(reason string) {
+	done := make(chan struct{})
+	go func() {
+		wt.sendCloseNotice(reason)
+		close(done)
+	}()
+
+	timer := time.NewTimer(closeNoticeTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("Gave up sending close notice to master (session %s)", wt.sessionID)
+	}
+}
@@ -0,0 +1,45 @@
+package webtty
+
+import (
+	"context"
+	"time"
+)
+
+// rateLimiter paces output of the slave to a rate in bytes per second.
+// It's used only by the goroutine reading the slave.
+type rateLimiter struct {
+	bytesPerSec int
+	next        time.Time // when the next output can be sent
+}
+
+// wait blocks until n bytes can be sent, or the context is canceled.
+func (rl *rateLimiter) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	delay := rl.next.Sub(now)
+	rl.next = rl.next.Add(time.Duration(n) * time.Second / time.Duration(rl.bytesPerSec))
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttleOutput waits for the output rate limit before sending n bytes.
+func (wt *WebTTY) throttleOutput(ctx context.Context, n int) error {
+	if wt.rateLimiter == nil {
+		return nil
+	}
+	return wt.rateLimiter.wait(ctx, n)
+}
@@ -0,0 +1,195 @@
+package webtty
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// replayChunkSize is the maximum size of output replayed in one message.
+const replayChunkSize = 32 * 1024
+
+// replayChunkLimit returns the maximum size of output replayed in one message.
+func (wt *WebTTY) replayChunkLimit() int {
+	limit := wt.maxOutputChunk()
+	if limit <= 0 || limit > replayChunkSize {
+		return replayChunkSize
+	}
+	return limit
+}
+
+// ReconnectToken returns the token sent to the master
+// in a SetReconnectToken message when reattaching is enabled.
+// A reconnecting client presents it so that the host can find
+// the WebTTY to Reattach to, instead of starting a new slave.
+func (wt *WebTTY) ReconnectToken() string {
+	return wt.reconnectToken
+}
+
+// AttachCount returns how many times the master has been replaced by Reattach.
+func (wt *WebTTY) AttachCount() int {
+	return int(atomic.LoadInt64(&wt.attachGeneration))
+}
+
+// Reattach replaces the master of a running session with m.
+// It's available when the WebTTY is created WithReattach.
+// The initializing messages are sent to m again, followed by
+// the scrollback when it's enabled, and then the session goes on
+// with the same slave.
+// The previous master is no longer read nor written; closing it
+// is caller's responsibility.
+func (wt *WebTTY) Reattach(m Master) error {
+	if !wt.reattach {
+		return errors.New("reattaching is not enabled")
+	}
+
+	messages, err := wt.initializeMessages(true)
+	if err != nil {
+		return err
+	}
+
+	wt.writeMutex.Lock()
+	defer wt.writeMutex.Unlock()
+
+	wt.masterConn = m
+	wt.detached = false
+	wt.stopReattachTimer()
+	generation := atomic.AddInt64(&wt.attachGeneration, 1)
+
+	// compression and capabilities are negotiated again with the new master
+	wt.stateMutex.Lock()
+	wt.compressionAcked = false
+	wt.binaryOutput = false
+	wt.resizeAck = false
+	wt.stateMutex.Unlock()
+
+	for _, message := range messages {
+		err := wt.writeFrameLocked(EncodeMessage(message))
+		if err != nil {
+			wt.detachLocked(generation)
+			return errors.Wrapf(err, "failed to send initializing message %s", OutputMessageType(message.Type))
+		}
+	}
+
+	err = wt.replayScrollbackLocked()
+	if err != nil {
+		wt.detachLocked(generation)
+		return err
+	}
+
+	go wt.readMaster(m, generation)
+
+	return nil
+}
+
+// replayScrollbackLocked sends the scrollback to the master
+// with writeMutex held.
+func (wt *WebTTY) replayScrollbackLocked() error {
+	if wt.scrollback == nil {
+		return nil
+	}
+
+	data := wt.scrollback.Bytes()
+	limit := wt.replayChunkLimit()
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > limit {
+			chunk = chunk[:limit]
+		}
+		data = data[len(chunk):]
+
+		frame, err := wt.outputFrame(chunk)
+		if err != nil {
+			return err
+		}
+		err = wt.writeFrameLocked(*frame)
+		putFrame(frame)
+		if err != nil {
+			return errors.Wrapf(err, "failed to replay scrollback")
+		}
+	}
+
+	return nil
+}
+
+// resetTerminal is the escape sequence to reset the terminal of the master
+// before a redraw.
+var resetTerminal = []byte("\x1bc")
+
+// redraw resets the terminal of the master and replays the scrollback
+// to bring the master back in sync. It does nothing without a scrollback.
+func (wt *WebTTY) redraw() error {
+	if wt.scrollback == nil {
+		return nil
+	}
+
+	wt.writeMutex.Lock()
+	defer wt.writeMutex.Unlock()
+
+	data := append(append([]byte{}, resetTerminal...), wt.scrollback.Bytes()...)
+	limit := wt.replayChunkLimit()
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > limit {
+			chunk = chunk[:limit]
+		}
+		data = data[len(chunk):]
+
+		frame, err := wt.outputFrame(chunk)
+		if err != nil {
+			return err
+		}
+		err = wt.masterWriteFrameLocked(*frame)
+		putFrame(frame)
+		if err != nil {
+			return errors.Wrapf(err, "failed to redraw")
+		}
+	}
+
+	return nil
+}
+
+// masterClosed is called when reading the master of the generation fails.
+func (wt *WebTTY) masterClosed(generation int64) {
+	if !wt.reattach {
+		wt.reportError(ErrMasterClosed)
+		return
+	}
+
+	wt.writeMutex.Lock()
+	defer wt.writeMutex.Unlock()
+	wt.detachLocked(generation)
+}
+
+// detachLocked marks the master of the generation detached
+// with writeMutex held.
+// Run returns ErrMasterClosed unless another master is attached
+// in the reattach timeout.
+func (wt *WebTTY) detachLocked(generation int64) {
+	if atomic.LoadInt64(&wt.attachGeneration) != generation || wt.detached {
+		return
+	}
+	wt.detached = true
+
+	if wt.reattachTimeout > 0 {
+		timer := time.AfterFunc(wt.reattachTimeout, func() {
+			if atomic.LoadInt64(&wt.attachGeneration) == generation {
+				wt.reportError(ErrMasterClosed)
+			}
+		})
+		wt.stateMutex.Lock()
+		wt.reattachTimer = timer
+		wt.stateMutex.Unlock()
+	}
+}
+
+// stopReattachTimer stops waiting for a master to be attached.
+func (wt *WebTTY) stopReattachTimer() {
+	wt.stateMutex.Lock()
+	defer wt.stateMutex.Unlock()
+	if wt.reattachTimer != nil {
+		wt.reattachTimer.Stop()
+		wt.reattachTimer = nil
+	}
+}
@@ -0,0 +1,22 @@
+package webtty
+
+import (
+	"time"
+)
+
+// ReconnectPolicy is the payload of SetReconnectPolicy messages.
+// The client waits Base seconds before the first reconnection attempt,
+// and multiplies the delay by Multiplier after each failure up to Max seconds.
+type ReconnectPolicy struct {
+	Base       float64 `json:"base"`
+	Max        float64 `json:"max"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+func newReconnectPolicy(base, max time.Duration, multiplier float64) *ReconnectPolicy {
+	return &ReconnectPolicy{
+		Base:       base.Seconds(),
+		Max:        max.Seconds(),
+		Multiplier: multiplier,
+	}
+}
@@ -0,0 +1,111 @@
+package webtty
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRespawnDelay is the default delay before respawning a slave.
+const DefaultRespawnDelay = time.Second
+
+// SlaveFactory creates a new slave to replace a closed one.
+type SlaveFactory func() (Slave, error)
+
+// currentSlave returns the slave in use, which changes in respawn mode.
+func (wt *WebTTY) currentSlave() Slave {
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+	return wt.slave
+}
+
+// respawnable reports whether the slave is replaced when it gets closed.
+func (wt *WebTTY) respawnable() bool {
+	if wt.respawnFactory == nil {
+		return false
+	}
+	return wt.respawnMax == 0 || wt.respawns < wt.respawnMax
+}
+
+// runSlave reads the slave until an error occurs,
+// replacing the slave with a new one each time it gets closed
+// in respawn mode.
+func (wt *WebTTY) runSlave(ctx context.Context) error {
+	for {
+		var err error
+		if wt.writeQueueDepth > 0 {
+			err = wt.readSlaveQueued(ctx)
+		} else {
+			err = wt.readSlave(ctx)
+		}
+		if err != ErrSlaveClosed || !wt.respawnable() {
+			return err
+		}
+
+		err = wt.respawn(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// respawn replaces the closed slave with a new one created by the factory
+// after the respawn delay, and initializes the master again.
+func (wt *WebTTY) respawn(ctx context.Context) error {
+	wt.respawns++
+
+	timer := time.NewTimer(wt.respawnDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	slave, err := wt.respawnFactory()
+	if err != nil {
+		return errors.Wrapf(err, "failed to respawn slave (%d of %d)", wt.respawns, wt.respawnMax)
+	}
+
+	wt.stateMutex.Lock()
+	closed, respawned := wt.slave, wt.respawned
+	wt.slave = slave
+	wt.respawned = true
+	size := wt.terminalSize
+	wt.stateMutex.Unlock()
+
+	if respawned {
+		closeSlave(closed)
+	}
+
+	if size.columns != 0 && size.rows != 0 {
+		slave.ResizeTerminal(size.columns, size.rows)
+	}
+
+	err = wt.sendInitializeMessage()
+	if err != nil {
+		return errors.Wrapf(err, "failed to send initializing message after respawn")
+	}
+
+	return nil
+}
+
+// closeRespawnedSlave closes the last slave created by the factory.
+func (wt *WebTTY) closeRespawnedSlave() {
+	wt.stateMutex.RLock()
+	slave, respawned := wt.slave, wt.respawned
+	wt.stateMutex.RUnlock()
+
+	if respawned {
+		closeSlave(slave)
+	}
+}
+
+// closeSlave closes a slave created by the factory when it's closable.
+func closeSlave(slave Slave) {
+	if closer, ok := slave.(io.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,128 @@
+package webtty
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// runSettings are the settings that RunWith can override for a run.
+type runSettings struct {
+	permitWrite bool
+	outputOnly  bool
+	columns     int
+	rows        int
+	reconnect   int
+	windowTitle []byte
+	masterPrefs []byte
+	preferences *Preferences
+}
+
+// runSettingFields are the names of the fields of WebTTY in runSettings.
+var runSettingFields = map[string]bool{
+	"permitWrite": true,
+	"outputOnly":  true,
+	"columns":     true,
+	"rows":        true,
+	"reconnect":   true,
+	"windowTitle": true,
+	"masterPrefs": true,
+	"preferences": true,
+}
+
+// RunWith works like Run, applying options only for this run,
+// e.g. to permit writing for a connection authorized at the HTTP upgrade.
+// The settings of the WebTTY are restored when RunWith returns.
+// Options accepted at run time are WithPermitWrite, WithOutputOnly,
+// WithFixedColumns, WithFixedRows, WithReconnect, WithWindowTitle,
+// WithPreferences and WithMasterPreferences.
+// Returns an error without running for other options, which should be given to New.
+func (wt *WebTTY) RunWith(ctx context.Context, options ...Option) error {
+	saved, err := wt.applyRunOptions(options)
+	if err != nil {
+		return errors.Wrapf(err, "invalid option (session %s)", wt.sessionID)
+	}
+	defer wt.restoreRunSettings(saved)
+
+	return wt.Run(ctx)
+}
+
+// applyRunOptions applies options, returning the settings before them.
+// Options are applied to a scratch WebTTY first, and nothing is changed
+// when one of them fails or sets anything other than runSettings.
+func (wt *WebTTY) applyRunOptions(options []Option) (runSettings, error) {
+	wt.writeMutex.Lock()
+	defer wt.writeMutex.Unlock()
+	wt.stateMutex.Lock()
+	defer wt.stateMutex.Unlock()
+
+	saved := wt.runSettingsLocked()
+
+	scratch := &WebTTY{}
+	scratch.setRunSettingsLocked(saved)
+	for _, option := range options {
+		err := option(scratch)
+		if err != nil {
+			return saved, err
+		}
+	}
+
+	value := reflect.ValueOf(scratch).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		if !runSettingFields[name] && !value.Field(i).IsZero() {
+			return saved, errors.Errorf("option setting %s can't be given at run time", name)
+		}
+	}
+
+	wt.setRunSettingsLocked(scratch.runSettingsLocked())
+	return saved, nil
+}
+
+func (wt *WebTTY) restoreRunSettings(saved runSettings) {
+	wt.writeMutex.Lock()
+	defer wt.writeMutex.Unlock()
+	wt.stateMutex.Lock()
+	defer wt.stateMutex.Unlock()
+
+	wt.setRunSettingsLocked(saved)
+}
+
+// currentRunSettings returns the settings of the current run.
+func (wt *WebTTY) currentRunSettings() runSettings {
+	wt.writeMutex.Lock()
+	defer wt.writeMutex.Unlock()
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+
+	return wt.runSettingsLocked()
+}
+
+// runSettingsLocked returns the current settings
+// with writeMutex and stateMutex held.
+func (wt *WebTTY) runSettingsLocked() runSettings {
+	return runSettings{
+		permitWrite: wt.permitWrite,
+		outputOnly:  wt.outputOnly,
+		columns:     wt.columns,
+		rows:        wt.rows,
+		reconnect:   wt.reconnect,
+		windowTitle: wt.windowTitle,
+		masterPrefs: wt.masterPrefs,
+		preferences: wt.preferences,
+	}
+}
+
+// setRunSettingsLocked sets the settings
+// with writeMutex and stateMutex held.
+func (wt *WebTTY) setRunSettingsLocked(settings runSettings) {
+	wt.permitWrite = settings.permitWrite
+	wt.outputOnly = settings.outputOnly
+	wt.columns = settings.columns
+	wt.rows = settings.rows
+	wt.reconnect = settings.reconnect
+	wt.windowTitle = settings.windowTitle
+	wt.masterPrefs = settings.masterPrefs
+	wt.preferences = settings.preferences
+}
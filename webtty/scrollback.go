@@ -0,0 +1,47 @@
+package webtty
+
+// scrollback is a ring buffer keeping the last output of the slave.
+// Output is kept raw and encoded when it's replayed,
+// as the encoding negotiated by each master can differ.
+type scrollback struct {
+	buffer []byte
+	start  int
+	length int
+}
+
+func newScrollback(size int) *scrollback {
+	return &scrollback{buffer: make([]byte, size)}
+}
+
+// Write appends data, discarding the oldest bytes when the buffer is full.
+func (sb *scrollback) Write(data []byte) {
+	size := len(sb.buffer)
+	if len(data) >= size {
+		copy(sb.buffer, data[len(data)-size:])
+		sb.start = 0
+		sb.length = size
+		return
+	}
+
+	end := (sb.start + sb.length) % size
+	n := copy(sb.buffer[end:], data)
+	copy(sb.buffer, data[n:])
+
+	sb.length += len(data)
+	if sb.length > size {
+		sb.start = (sb.start + sb.length - size) % size
+		sb.length = size
+	}
+}
+
+// Bytes returns a copy of the kept bytes, the oldest first.
+func (sb *scrollback) Bytes() []byte {
+	data := make([]byte, sb.length)
+	end := sb.start + sb.length
+	if end > len(sb.buffer) {
+		end = len(sb.buffer)
+	}
+	n := copy(data, sb.buffer[sb.start:end])
+	copy(data[n:], sb.buffer[:sb.length-n])
+	return data
+}
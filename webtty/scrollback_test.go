@@ -0,0 +1,61 @@
+package webtty
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestScrollback(t *testing.T) {
+	sb := newScrollback(8)
+
+	sb.Write([]byte("foo"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("foo")) {
+		t.Fatalf("Unexpected scrollback: `%s`", data)
+	}
+
+	sb.Write([]byte("barbaz"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("oobarbaz")) {
+		t.Fatalf("Unexpected scrollback: `%s`", data)
+	}
+
+	sb.Write([]byte("qux"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("arbazqux")) {
+		t.Fatalf("Unexpected scrollback: `%s`", data)
+	}
+
+	sb.Write([]byte("0123456789"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("23456789")) {
+		t.Fatalf("Unexpected scrollback: `%s`", data)
+	}
+}
+
+func TestCompressedScrollback(t *testing.T) {
+	const size = 1024 * 1024
+	sb := newCompressedScrollback(size)
+
+	sb.Write([]byte("foo"))
+	if data := sb.Bytes(); !bytes.Equal(data, []byte("foo")) {
+		t.Fatalf("Unexpected scrollback: `%s`", data)
+	}
+
+	var written bytes.Buffer
+	written.WriteString("foo")
+	for i := 0; written.Len() < 3*size; i++ {
+		line := []byte(fmt.Sprintf("%d: the quick brown fox jumps over the lazy dog\r\n", i))
+		sb.Write(line)
+		written.Write(line)
+	}
+	// larger than a block at once
+	chunk := bytes.Repeat([]byte("0123456789"), scrollbackBlockSize/5)
+	sb.Write(chunk)
+	written.Write(chunk)
+
+	expected := written.Bytes()[written.Len()-size:]
+	if data := sb.Bytes(); !bytes.Equal(data, expected) {
+		t.Fatalf("Unexpected scrollback of %d bytes", len(data))
+	}
+	if n := sb.memorySize(); n > size/4 {
+		t.Fatalf("Too much memory used for the scrollback: %d bytes", n)
+	}
+}
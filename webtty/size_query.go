@@ -0,0 +1,87 @@
+package webtty
+
+import (
+	"fmt"
+	"log"
+)
+
+// maxCSIParams is the maximum length of CSI parameters kept by sizeQueryParser,
+// the queries it looks for have short ones.
+const maxCSIParams = 16
+
+const (
+	csiGround = iota
+	csiEscape // got ESC
+	csiParams // in the parameters of a CSI sequence
+)
+
+// sizeQueryParser finds queries of the terminal size in output of the slave:
+// `CSI 18 t`, reporting the size of the text area, and
+// `CSI 6 n`, reporting the cursor position.
+// Sequences split across reads are handled by keeping the state.
+type sizeQueryParser struct {
+	state  int
+	params []byte
+}
+
+// parse feeds data to the parser, calling f with the final byte of each query.
+func (p *sizeQueryParser) parse(data []byte, f func(final byte)) {
+	for _, b := range data {
+		switch p.state {
+		case csiGround:
+			if b == 0x1b {
+				p.state = csiEscape
+			}
+
+		case csiEscape:
+			if b == '[' {
+				p.state = csiParams
+				p.params = p.params[:0]
+			} else if b != 0x1b {
+				p.state = csiGround
+			}
+
+		case csiParams:
+			switch {
+			case (b >= '0' && b <= '9') || b == ';':
+				if len(p.params) >= maxCSIParams {
+					p.state = csiGround
+					break
+				}
+				p.params = append(p.params, b)
+			case b == 't' && string(p.params) == "18", b == 'n' && string(p.params) == "6":
+				p.state = csiGround
+				f(b)
+			case b == 0x1b:
+				p.state = csiEscape
+			default:
+				p.state = csiGround
+			}
+		}
+	}
+}
+
+// answerSizeQueries writes reports of the terminal size to the slave
+// for the queries in its output.
+// The cursor position is reported at the bottom right corner,
+// answering programs that move the cursor there to learn the size.
+// Nothing is reported until the size is known.
+func (wt *WebTTY) answerSizeQueries(data []byte) {
+	wt.sizeQueries.parse(data, func(final byte) {
+		columns, rows := wt.TerminalSize()
+		if columns == 0 || rows == 0 {
+			return
+		}
+
+		var report string
+		if final == 't' {
+			report = fmt.Sprintf("\x1b[8;%d;%dt", rows, columns)
+		} else {
+			report = fmt.Sprintf("\x1b[%d;%dR", rows, columns)
+		}
+		err := wt.slaveWrite([]byte(report))
+		if err != nil {
+			log.Printf("Failed to answer a terminal size query: %s (session %s)", err, wt.sessionID)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package webtty
+
+import (
+	"testing"
+)
+
+func TestAnswerSizeQueries(t *testing.T) {
+	ts := newTestSession(t, WithAnswerSizeQueries())
+	defer ts.close(t)
+
+	ts.readInit(t)
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":80,"rows":24}`...))
+	waitFor(t, func() bool {
+		columns, rows := ts.dt.TerminalSize()
+		return columns == 80 && rows == 24
+	})
+
+	for _, tc := range []struct {
+		output   []string
+		expected string
+	}{
+		{output: []string{"\x1b[999;999H\x1b[6n"}, expected: "\x1b[24;80R"},
+		{output: []string{"foo\x1b[1", "8t"}, expected: "\x1b[8;24;80t"},
+	} {
+		go func() {
+			for _, output := range tc.output {
+				ts.slaveOut.Write([]byte(output))
+			}
+		}()
+		go func() {
+			// output is still sent to the master
+			for range tc.output {
+				ts.readFrame(t)
+			}
+		}()
+
+		if report := ts.readSlaveInput(t); string(report) != tc.expected {
+			t.Fatalf("Unexpected report written to the slave: %q", report)
+		}
+	}
+}
+
+func TestSizeQueryParser(t *testing.T) {
+	var p sizeQueryParser
+	var finals []byte
+	for _, data := range []string{"\x1b[6n", "\x1b[5n", "\x1b[18;1t", "\x1b\x1b[18t", "\x1b]6n"} {
+		p.parse([]byte(data), func(final byte) {
+			finals = append(finals, final)
+		})
+	}
+	if string(finals) != "nt" {
+		t.Fatalf("Unexpected queries found: %q", finals)
+	}
+}
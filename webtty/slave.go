@@ -1,6 +1,7 @@
 package webtty
 
 import (
+	"context"
 	"io"
 )
 
@@ -15,3 +16,21 @@ type Slave interface {
 	// ResizeTerminal sets a new size of the terminal.
 	ResizeTerminal(columns int, rows int) error
 }
+
+// ExitStatusReporter is an optional interface of Slave
+// to report the exit status of the command when the slave is closed.
+type ExitStatusReporter interface {
+	// ExitStatus returns the exit status of the command,
+	// or a negative value when it's unknown.
+	ExitStatus() int
+}
+
+// ContextReader is an optional interface of Slave
+// to abort reading when the context is canceled.
+// When a slave implements it, the goroutine reading the slave
+// exits as soon as Run returns.
+type ContextReader interface {
+	// ReadContext works like Read, but returns ctx.Err()
+	// when the context get canceled before any data is read.
+	ReadContext(ctx context.Context, p []byte) (n int, err error)
+}
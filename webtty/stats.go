@@ -0,0 +1,82 @@
+package webtty
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DirectionToMaster is the direction of data sent to the master
+	DirectionToMaster = "to_master"
+	// DirectionToSlave is the direction of data sent to the slave
+	DirectionToSlave = "to_slave"
+	// DirectionFromMaster is the direction of messages received from the master
+	DirectionFromMaster = "from_master"
+)
+
+// MetricsObserver receives traffic events of a session.
+// It can be used to bridge the counters to a metrics system
+// such as Prometheus.
+type MetricsObserver interface {
+	// ObserveBytes is called when n bytes are written in the direction.
+	ObserveBytes(direction string, n int)
+	// IncPing is called when a Ping message is received.
+	IncPing()
+}
+
+// Stats represents traffic counters of a WebTTY session.
+type Stats struct {
+	// Bytes written to the master, including message type bytes
+	BytesToMaster int64
+	// Bytes written to the slave
+	BytesToSlave int64
+	// Number of messages written to the master
+	FramesToMaster int64
+	// Number of input messages written to the slave
+	FramesToSlave int64
+	// Number of Ping messages received from the master
+	Pings int64
+}
+
+// Stats returns a snapshot of the traffic counters of the session.
+func (wt *WebTTY) Stats() Stats {
+	return Stats{
+		BytesToMaster:  atomic.LoadInt64(&wt.stats.BytesToMaster),
+		BytesToSlave:   atomic.LoadInt64(&wt.stats.BytesToSlave),
+		FramesToMaster: atomic.LoadInt64(&wt.stats.FramesToMaster),
+		FramesToSlave:  atomic.LoadInt64(&wt.stats.FramesToSlave),
+		Pings:          atomic.LoadInt64(&wt.stats.Pings),
+	}
+}
+
+// LastActivity returns the last time data was written to the master
+// or the slave, or the time the WebTTY was created before any transfer.
+func (wt *WebTTY) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&wt.lastActivity))
+}
+
+func (wt *WebTTY) observeBytes(direction string, n int) {
+	if n > 0 {
+		atomic.StoreInt64(&wt.lastActivity, time.Now().UnixNano())
+	}
+	if wt.metrics != nil {
+		wt.metrics.ObserveBytes(direction, n)
+	}
+}
+
+func (wt *WebTTY) incPing() {
+	if wt.metrics != nil {
+		wt.metrics.IncPing()
+	}
+}
+
+// observeFrame passes a copy of a message to the frame observer,
+// as frames are in reused buffers, and records it in the protocol trace.
+func (wt *WebTTY) observeFrame(direction string, frame []byte) {
+	if wt.frameObserver != nil {
+		wt.frameObserver(direction, append([]byte(nil), frame...))
+	}
+	if wt.trace != nil {
+		wt.trace.record(direction, frame)
+	}
+}
@@ -0,0 +1,33 @@
+package webtty
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxTitleLength is the max length of window titles in bytes.
+const maxTitleLength = 1024
+
+var (
+	oscIconAndTitle = []byte("0;") // sets the icon name and the window title
+	oscTitle        = []byte("2;")
+)
+
+// sanitizeTitle removes control characters, which could be interpreted
+// by the terminal of the master, and truncates the title to maxTitleLength.
+// Invalid UTF-8 sequences are replaced with U+FFFD.
+func sanitizeTitle(title []byte) []byte {
+	sanitized := make([]byte, 0, len(title))
+	for len(title) > 0 {
+		r, size := utf8.DecodeRune(title)
+		title = title[size:]
+		if unicode.IsControl(r) {
+			continue
+		}
+		if len(sanitized)+utf8.RuneLen(r) > maxTitleLength {
+			break
+		}
+		sanitized = utf8.AppendRune(sanitized, r)
+	}
+	return sanitized
+}
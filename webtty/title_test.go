@@ -0,0 +1,78 @@
+package webtty
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWindowTitleSanitized(t *testing.T) {
+	ts := newTestSession(t, WithWindowTitle([]byte("top\n\x1b]0;evil\a - host\r\u009b")))
+	defer ts.close(t)
+
+	frame := ts.readInit(t)[0]
+	if !bytes.Equal(frame, append([]byte{SetWindowTitle}, "top]0;evil - host"...)) {
+		t.Fatalf("Unexpected title message: %q", frame)
+	}
+}
+
+func TestSanitizeTitle(t *testing.T) {
+	for _, tc := range []struct {
+		title    string
+		expected string
+	}{
+		{title: "bash - host", expected: "bash - host"},
+		{title: "tab\there", expected: "tabhere"},
+		{title: "été\u0085", expected: "été"},
+		{title: "bad\xffutf8", expected: "bad�utf8"},
+		{title: strings.Repeat("a", 2000), expected: strings.Repeat("a", maxTitleLength)},
+		{title: strings.Repeat("a", maxTitleLength-1) + "é", expected: strings.Repeat("a", maxTitleLength-1)},
+	} {
+		sanitized := sanitizeTitle([]byte(tc.title))
+		if string(sanitized) != tc.expected {
+			t.Errorf("Unexpected sanitized title of %q: %q", tc.title, sanitized)
+		}
+	}
+}
+
+func TestDynamicTitle(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output string
+		title  string
+	}{
+		{name: "7-bit BEL", output: "\x1b]0;vim\a", title: "vim"},
+		{name: "7-bit ST", output: "\x1b]2;vim\x1b\\", title: "vim"},
+		{name: "8-bit", output: "\x9d2;vim\x9c", title: "vim"},
+		{name: "8-bit OSC with BEL", output: "\x9d0;vim\a", title: "vim"},
+		// 0x9D and 0x9C are continuation bytes of `ŝ` and `Ŝ`
+		{name: "UTF-8", output: "ŝ\x1b]0;Ŝ\a", title: "Ŝ"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestSession(t, WithDynamicTitle())
+			defer ts.close(t)
+
+			ts.readInit(t)
+			go ts.slaveOut.Write([]byte(tc.output))
+
+			if frame := ts.readFrame(t); !bytes.Equal(frame, append([]byte{SetWindowTitle}, tc.title...)) {
+				t.Fatalf("Unexpected message received: %q", frame)
+			}
+			if frame := ts.readFrame(t); frame[0] != Output {
+				t.Fatalf("Unexpected message received: %q", frame)
+			}
+		})
+	}
+}
+
+func TestDynamicTitleIgnoresIconName(t *testing.T) {
+	ts := newTestSession(t, WithDynamicTitle())
+	defer ts.close(t)
+
+	ts.readInit(t)
+	go ts.slaveOut.Write([]byte("\x1b]1;icon\a"))
+
+	if frame := ts.readFrame(t); frame[0] != Output {
+		t.Fatalf("Unexpected message received: %q", frame)
+	}
+}
@@ -0,0 +1,40 @@
+package webtty
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// protocolTrace writes a line for each message to and from the master.
+// Each line is the time in RFC 3339 format with microseconds in UTC,
+// the direction, the name of the message type and the length of the payload,
+// separated by spaces:
+//
+//	2006-01-02T15:04:05.000000Z from_master Ping 0
+type protocolTrace struct {
+	mutex sync.Mutex // serializes lines written from multiple goroutines
+	w     io.Writer
+}
+
+const traceTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func (pt *protocolTrace) record(direction string, frame []byte) {
+	if len(frame) == 0 {
+		// not decoded to a message
+		return
+	}
+
+	var name string
+	if direction == DirectionFromMaster {
+		name = MessageType(frame[0]).String()
+	} else {
+		name = OutputMessageType(frame[0]).String()
+	}
+
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	// tracing never fails the session
+	fmt.Fprintf(pt.w, "%s %s %s %d\n", time.Now().UTC().Format(traceTimeFormat), direction, name, len(frame)-1)
+}
@@ -0,0 +1,83 @@
+package webtty
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// traceBuffer is a buffer written by the trace and read by the test concurrently.
+type traceBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (tb *traceBuffer) Write(p []byte) (int, error) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	return tb.buf.Write(p)
+}
+
+func (tb *traceBuffer) Bytes() []byte {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	return append([]byte(nil), tb.buf.Bytes()...)
+}
+
+func (tb *traceBuffer) lines() int {
+	return bytes.Count(tb.Bytes(), []byte("\n"))
+}
+
+func TestProtocolTrace(t *testing.T) {
+	var trace traceBuffer
+	ts := newTestSession(t, WithPermitWrite(), WithProtocolTrace(&trace))
+
+	ts.readInit(t)
+
+	ts.masterIn.Write(append([]byte{Ping}, "1234"...))
+	ts.readFrame(t)
+
+	ts.masterIn.Write(append([]byte{Input}, "ls\n"...))
+	buf := make([]byte, 1024)
+	ts.slaveIn.Read(buf)
+
+	go ts.slaveOut.Write([]byte("hello"))
+	ts.readFrame(t)
+	// outgoing messages are recorded after being written
+	waitFor(t, func() bool { return trace.lines() == 6 })
+
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":80,"rows":24}`...))
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+	waitFor(t, func() bool { return trace.lines() == 9 })
+
+	ts.close(t)
+
+	// timestamps differ run by run
+	timestamp := regexp.MustCompile(`(?m)^\S+ `)
+	actual := timestamp.ReplaceAll(trace.Bytes(), nil)
+	if !timestamp.Match(trace.Bytes()) {
+		t.Fatalf("No timestamps in the trace: %q", trace.Bytes())
+	}
+
+	golden := filepath.Join("testdata", "trace.golden")
+	if *update {
+		err := ioutil.WriteFile(golden, actual, 0644)
+		if err != nil {
+			t.Fatalf("Unexpected error from WriteFile(): %s", err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Unexpected error from ReadFile(): %s", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("Unexpected trace:\n%s\nexpected:\n%s", actual, expected)
+	}
+}
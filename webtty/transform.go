@@ -0,0 +1,17 @@
+package webtty
+
+// Transform rewrites data passing through a session, such as redacting secrets.
+// It returns the data to pass on, which can be data itself modified in place.
+// Returning empty data drops it.
+type Transform func(data []byte) []byte
+
+// applyTransforms passes data through the transforms in order.
+func applyTransforms(transforms []Transform, data []byte) []byte {
+	for _, transform := range transforms {
+		if len(data) == 0 {
+			break
+		}
+		data = transform(data)
+	}
+	return data
+}
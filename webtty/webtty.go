@@ -2,37 +2,154 @@ package webtty
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/pkg/randomstring"
 )
 
 // WebTTY bridges a PTY slave and its PTY master.
 // To support text-based streams and side channel commands such as
 // terminal resizing, WebTTY uses an original protocol.
 type WebTTY struct {
+	// Updated atomically, kept first for 64-bit alignment on 32-bit platforms
+	stats Stats
+	// Incremented atomically when a master is attached by Reattach
+	attachGeneration int64
+	// Bytes transferred in both directions, updated atomically
+	quotaUsed int64
+	// Time of the last transfer in UnixNano, updated atomically
+	lastActivity int64
+
 	// PTY Master, which probably a connection to browser
 	masterConn Master
-	// PTY Slave
+	// Carries control messages instead of masterConn, nil when disabled
+	control         Master
+	controlMessages chan []byte // read by handleControl of the running Run
+	// PTY Slave, replaced in respawn mode and protected by stateMutex
 	slave Slave
 
-	windowTitle []byte
-	permitWrite bool
-	columns     int
-	rows        int
-	reconnect   int // in seconds
-	masterPrefs []byte
+	sessionID    string
+	windowTitle  []byte
+	permitWrite  bool
+	outputOnly   bool
+	columns      int
+	rows         int
+	reconnect    int // in seconds
+	masterPrefs  []byte
+	clientConfig []byte // nil when disabled
+	preferences  *Preferences
+	metrics      MetricsObserver
+
+	frameObserver func(direction string, frame []byte) // nil when disabled
+	trace         *protocolTrace                       // nil when disabled
+
+	reconnectPolicy *ReconnectPolicy // nil when disabled
+
+	drainTimeout      time.Duration
+	errorGracePeriod  time.Duration
+	writeTimeout      time.Duration
+	slaveWriteTimeout time.Duration
+	deadWriters       deadWriters
+
+	ignoreUnknownMessages bool
+
+	compression      *compressor // nil when disabled
+	compressionAcked bool
+	binaryOutput     bool // enabled by SetClientInfo
+	resizeAck        bool // enabled by SetClientInfo
+	outputEncoding   Encoding
+
+	coalescer *coalescer // nil when disabled
+
+	writeQueueDepth int
+
+	rateLimiter *rateLimiter // nil when disabled
+
+	maxFrameSize int // zero when unlimited
+
+	initialInput     []byte
+	initialInputSent bool
+
+	banner []byte
+
+	byteQuota int64 // zero when unlimited
+
+	onBell  func()
+	onClose func(err error)
+
+	outputTee       io.Writer // nil when disabled
+	outputTeeFailed bool      // used only by the goroutine handling output
+
+	osc                  *oscParser // nil when no OSC sequence is handled
+	clipboardPassthrough bool
+	dynamicTitle         bool
+
+	sizeQueries *sizeQueryParser // nil when disabled
+
+	initialResizeDelay time.Duration
+	initialResizeTimer *time.Timer   // protected by stateMutex, nil until initialized
+	initialResizeDone  bool          // protected by stateMutex
+	pendingResize      *terminalSize // protected by stateMutex, held in the initial resize delay
+
+	dropInputOnce sync.Once
+	controlOnce   sync.Once
+
+	inputTransforms  []Transform
+	outputTransforms []Transform
+
+	inputNewline   NewlineMode
+	inputPendingCR bool // used only by the goroutine reading the master
+
+	respawnFactory SlaveFactory // nil when disabled
+	respawnMax     int
+	respawnDelay   time.Duration
+	respawns       int          // used only by the goroutine reading the slave
+	respawned      bool         // true once the slave is created by the factory
+	terminalSize   terminalSize // last size applied, protected by stateMutex
 
 	bufferSize int
 	writeMutex sync.Mutex
+	// Protects settings that can be modified while running
+	stateMutex sync.RWMutex
+
+	scrollback scrollbackBuffer // nil when disabled, protected by writeMutex
+
+	reattach        bool
+	reattachTimeout time.Duration
+	reconnectToken  string
+	detached        bool        // protected by writeMutex
+	reattachTimer   *time.Timer // protected by stateMutex, nil unless detached
+	runErrs         chan error
+
+	pauseMutex      sync.Mutex
+	paused          bool
+	pauseBuffer     *scrollback
+	pauseBufferSize int
+
+	observerMutex sync.Mutex
+	observers     []*observer
+	maxObservers  int // zero when unlimited
+
+	startMutex sync.Mutex
+	runDone    chan struct{} // closed when Run started by Start returns
+	runErr     error
 }
 
 // New creates a new instance of WebTTY.
 // masterConn is a connection to the PTY master,
 // typically it's a websocket connection to a client.
 // slave is a PTY slave such as a local command with a PTY.
+// Returns an error when one of the options is invalid.
 func New(masterConn Master, slave Slave, options ...Option) (*WebTTY, error) {
 	wt := &WebTTY{
 		masterConn: masterConn,
@@ -42,178 +159,930 @@ func New(masterConn Master, slave Slave, options ...Option) (*WebTTY, error) {
 		columns:     0,
 		rows:        0,
 
-		bufferSize: 1024,
+		bufferSize:       1024,
+		pauseBufferSize:  DefaultPauseBufferSize,
+		respawnDelay:     DefaultRespawnDelay,
+		errorGracePeriod: DefaultErrorGracePeriod,
+		outputEncoding:   EncodingBase64,
+
+		lastActivity: time.Now().UnixNano(),
 	}
 
 	for _, option := range options {
-		option(wt)
+		err := option(wt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid option")
+		}
+	}
+
+	if wt.reattach {
+		wt.reconnectToken = randomstring.Generate(32)
+	}
+
+	if wt.sessionID == "" {
+		id, err := generateSessionID()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to generate session ID")
+		}
+		wt.sessionID = id
 	}
 
 	return wt, nil
 }
 
+// SessionID returns the identifier of the session,
+// which can be used to correlate logs and errors.
+func (wt *WebTTY) SessionID() string {
+	return wt.sessionID
+}
+
 // Run starts the main process of the WebTTY.
 // This method blocks until the context is canceled.
 // Note that the master and slave are left intact even
 // after the context is canceled. Closing them is caller's
 // responsibility.
 // If the connection to one end gets closed, returns ErrSlaveClosed or ErrMasterClosed.
+// Returns ErrQuotaExceeded after sending ServerClose when the byte quota is used up.
+// When the context is canceled, ServerClose is sent with the cause of the cancellation,
+// giving up when writing to the master is blocked.
+// When both ends fail at nearly the same time, the error of the slave is returned,
+// see WithErrorGracePeriod.
+// Slaves created by the respawn factory are closed by Run when they implement io.Closer.
+// The function given by WithOnClose is called just before Run returns.
 func (wt *WebTTY) Run(ctx context.Context) error {
+	err := wt.run(ctx)
+	if wt.onClose != nil {
+		closeErr := err
+		if closeErr == context.Canceled {
+			closeErr = nil
+		}
+		wt.onClose(closeErr)
+	}
+	return err
+}
+
+func (wt *WebTTY) run(ctx context.Context) error {
 	err := wt.sendInitializeMessage()
 	if err != nil {
-		return errors.Wrapf(err, "failed to send initializing message")
+		return errors.Wrapf(err, "failed to send initializing message (session %s)", wt.sessionID)
+	}
+
+	if wt.initialResizeDelay > 0 {
+		wt.startInitialResizeDelay()
+	}
+
+	err = wt.sendInitialInput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to send initial input (session %s)", wt.sessionID)
 	}
 
+	// canceled when Run returns to stop reading the slave
+	readCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer wt.closeRespawnedSlave()
+
 	errs := make(chan error, 2)
+	wt.stateMutex.Lock()
+	wt.runErrs = errs
+	wt.stateMutex.Unlock()
+	defer func() {
+		wt.stateMutex.Lock()
+		wt.runErrs = nil
+		wt.stateMutex.Unlock()
 
-	go func() {
-		errs <- func() error {
-			buffer := make([]byte, wt.bufferSize)
-			for {
-				n, err := wt.slave.Read(buffer)
-				if err != nil {
-					return ErrSlaveClosed
-				}
-
-				err = wt.handleSlaveReadEvent(buffer[:n])
-				if err != nil {
-					return err
-				}
-			}
-		}()
+		// the reattach timeout of this run never ends a later run
+		wt.stopReattachTimer()
+		// the master is left to the caller
+		wt.stopOutputCoalesce()
+		wt.stopInitialResizeDelay()
 	}()
 
 	go func() {
-		errs <- func() error {
-			buffer := make([]byte, wt.bufferSize)
-			for {
-				n, err := wt.masterConn.Read(buffer)
-				if err != nil {
-					return ErrMasterClosed
-				}
-
-				err = wt.handleMasterReadEvent(buffer[:n])
-				if err != nil {
-					return err
-				}
-			}
-		}()
+		wt.reportError(wt.runSlave(readCtx))
 	}()
 
+	// messages sent by the master on connect, such as resizing,
+	// are read only after the initializing messages are sent
+	wt.writeMutex.Lock()
+	masterConn := wt.masterConn
+	wt.writeMutex.Unlock()
+	go wt.readMaster(masterConn, atomic.LoadInt64(&wt.attachGeneration))
+	if wt.control != nil {
+		wt.controlOnce.Do(func() {
+			wt.controlMessages = make(chan []byte)
+			go wt.readControl()
+		})
+		go wt.handleControl(readCtx)
+	}
+
 	select {
 	case <-ctx.Done():
 		err = ctx.Err()
+		wt.drain(errs)
+		// the master can be already gone or blocked, just try
+		wt.trySendCloseNotice(context.Cause(ctx).Error())
 	case err = <-errs:
+		err = wt.awaitSecondError(ctx, errs, err)
+		if err == ErrQuotaExceeded {
+			// the master can be already gone, just try
+			wt.sendCloseNotice(err.Error())
+			break
+		}
+		if typed := typedError(err); typed != nil {
+			err = typed
+			break
+		}
+		if cause := errors.Cause(err); cause != ErrSlaveClosed && cause != ErrMasterClosed {
+			err = errors.Wrapf(err, "session %s", wt.sessionID)
+		}
 	}
 
 	return err
 }
 
-func (wt *WebTTY) sendInitializeMessage() error {
-	err := wt.masterWrite(append([]byte{SetWindowTitle}, wt.windowTitle...))
+// reportError passes an error to Run, unless Run has already got one.
+func (wt *WebTTY) reportError(err error) {
+	wt.stateMutex.RLock()
+	errs := wt.runErrs
+	wt.stateMutex.RUnlock()
+
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
+// readMaster handles messages from the master until an error occurs.
+// generation is the attach generation of the master,
+// reading stops silently when another master is attached.
+func (wt *WebTTY) readMaster(masterConn Master, generation int64) {
+	buffer := make([]byte, wt.bufferSize)
+	for {
+		n, err := masterConn.Read(buffer)
+		if atomic.LoadInt64(&wt.attachGeneration) != generation {
+			return
+		}
+		if err != nil {
+			wt.masterClosed(generation)
+			return
+		}
+		if n == 0 {
+			// some streams return (0, nil), just retry
+			continue
+		}
+
+		err = wt.handleMasterReadEvent(buffer[:n])
+		if err != nil {
+			wt.reportError(err)
+			return
+		}
+	}
+}
+
+// SetWindowTitle sends a new window title to the master.
+// The title is also used when the initializing message is sent again.
+// Control characters are removed and long titles are truncated.
+func (wt *WebTTY) SetWindowTitle(title string) error {
+	sanitized := sanitizeTitle([]byte(title))
+
+	wt.writeMutex.Lock()
+	wt.windowTitle = sanitized
+	wt.writeMutex.Unlock()
+
+	err := wt.masterWrite(Message{SetWindowTitle, sanitized})
 	if err != nil {
 		return errors.Wrapf(err, "failed to send window title")
 	}
 
-	if wt.reconnect > 0 {
-		reconnect, _ := json.Marshal(wt.reconnect)
-		err := wt.masterWrite(append([]byte{SetReconnect}, reconnect...))
+	return nil
+}
+
+// Notify sends an informational message to the master,
+// which is supposed to be shown to the user, e.g. as a toast.
+func (wt *WebTTY) Notify(text string) error {
+	message, err := json.Marshal(text)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal server message")
+	}
+
+	err = wt.masterWrite(Message{ServerMessage, message})
+	if err != nil {
+		return errors.Wrapf(err, "failed to send server message")
+	}
+
+	return nil
+}
+
+// SetPermitWrite changes whether input from the master is written to the slave.
+// Writing is never permitted in output only mode.
+func (wt *WebTTY) SetPermitWrite(permitWrite bool) {
+	wt.stateMutex.Lock()
+	defer wt.stateMutex.Unlock()
+	wt.permitWrite = permitWrite
+}
+
+func (wt *WebTTY) writePermitted() bool {
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+	return wt.permitWrite && !wt.outputOnly
+}
+
+func (wt *WebTTY) outputOnlyMode() bool {
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+	return wt.outputOnly
+}
+
+// fixedSize returns the columns and rows kept on resizing, zero when not fixed.
+func (wt *WebTTY) fixedSize() (int, int) {
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+	return wt.columns, wt.rows
+}
+
+// Start runs Run in a new goroutine.
+// Use Wait to get the result.
+// Returns ErrAlreadyStarted when called more than once.
+func (wt *WebTTY) Start(ctx context.Context) error {
+	wt.startMutex.Lock()
+	defer wt.startMutex.Unlock()
+
+	if wt.runDone != nil {
+		return ErrAlreadyStarted
+	}
+
+	wt.runDone = make(chan struct{})
+	go func() {
+		wt.runErr = wt.Run(ctx)
+		close(wt.runDone)
+	}()
+
+	return nil
+}
+
+// Wait blocks until Run started by Start returns, and returns its error.
+// It can be called from multiple goroutines.
+// Returns ErrNotStarted when Start has not been called.
+func (wt *WebTTY) Wait() error {
+	wt.startMutex.Lock()
+	runDone := wt.runDone
+	wt.startMutex.Unlock()
+
+	if runDone == nil {
+		return ErrNotStarted
+	}
+
+	<-runDone
+	return wt.runErr
+}
+
+// readSlave forwards output of the slave to the master until an error occurs.
+func (wt *WebTTY) readSlave(ctx context.Context) error {
+	buffer := make([]byte, wt.bufferSize)
+	for {
+		n, err := wt.slaveRead(ctx, buffer)
+		if err != nil {
+			// output coalesced from the last reads goes before closing
+			wt.flushPendingOutput()
+			return wt.slaveReadError(ctx)
+		}
+
+		err = wt.throttleOutput(ctx, n)
+		if err != nil {
+			return err
+		}
+
+		err = wt.handleSlaveReadEvent(buffer[:n])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// slaveReadError returns the error for a failed read from the slave.
+func (wt *WebTTY) slaveReadError(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if wt.respawnable() {
+		// the master keeps going with a new slave
+		return ErrSlaveClosed
+	}
+	return wt.slaveClosed()
+}
+
+func (wt *WebTTY) slaveRead(ctx context.Context, buffer []byte) (int, error) {
+	slave := wt.currentSlave()
+	if reader, ok := slave.(ContextReader); ok {
+		return reader.ReadContext(ctx, buffer)
+	}
+	return slave.Read(buffer)
+}
+
+// drainIdle is how long drain waits for more output of the slave.
+// Output the slave has already written is read well within it.
+const drainIdle = 20 * time.Millisecond
+
+// drain keeps forwarding slave output to the master after the context
+// is canceled, until no output comes for drainIdle, one end gets closed
+// or the drain timeout passes. Output held by the coalescer is flushed.
+func (wt *WebTTY) drain(errs chan error) {
+	if wt.drainTimeout <= 0 {
+		return
+	}
+	defer wt.flushPendingOutput()
+
+	timeout := time.NewTimer(wt.drainTimeout)
+	defer timeout.Stop()
+
+	for {
+		wt.flushPendingOutput()
+		sent := atomic.LoadInt64(&wt.stats.BytesToMaster)
+
+		idle := time.NewTimer(drainIdle)
+		select {
+		case err := <-errs:
+			idle.Stop()
+			log.Printf("Stopped draining output: %s (session %s)", err, wt.sessionID)
+			return
+		case <-timeout.C:
+			idle.Stop()
+			return
+		case <-idle.C:
+		}
+
+		if atomic.LoadInt64(&wt.stats.BytesToMaster) == sent {
+			return
+		}
+	}
+}
+
+// awaitSecondError waits for the other end to fail in the error grace period
+// when the first error is closing of the master, which is often caused by
+// the slave exiting at the same time, and returns the error to take precedence.
+// Errors of the slave take precedence over other errors,
+// and errors of the master are returned only when no other error occurs.
+func (wt *WebTTY) awaitSecondError(ctx context.Context, errs chan error, first error) error {
+	if wt.errorGracePeriod <= 0 || errorPrecedence(first) != precedenceMaster {
+		return first
+	}
+
+	timer := time.NewTimer(wt.errorGracePeriod)
+	defer timer.Stop()
+
+	select {
+	case second := <-errs:
+		if errorPrecedence(second) > errorPrecedence(first) {
+			log.Printf("Ignoring master error after the other error: %s (session %s)", first, wt.sessionID)
+			return second
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return first
+}
+
+const (
+	precedenceMaster = iota
+	precedenceOther
+	precedenceSlave
+)
+
+func errorPrecedence(err error) int {
+	switch errors.Cause(err) {
+	case ErrMasterClosed:
+		return precedenceMaster
+	case ErrSlaveClosed:
+		return precedenceSlave
+	}
+	return precedenceOther
+}
+
+// slaveClosed notifies the master of the exit status of the slave
+// when available, and returns the error to be returned by Run.
+func (wt *WebTTY) slaveClosed() error {
+	reporter, ok := wt.currentSlave().(ExitStatusReporter)
+	if !ok {
+		return ErrSlaveClosed
+	}
+
+	code := reporter.ExitStatus()
+	if code < 0 {
+		return ErrSlaveClosed
+	}
+
+	exit, _ := json.Marshal(code)
+	// the master can be already gone, just try
+	wt.masterWrite(Message{Exit, exit})
+
+	return &ExitError{code: code}
+}
+
+func (wt *WebTTY) sendInitializeMessage() error {
+	messages, err := wt.initializeMessages(true)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		err := wt.primaryWrite(message)
 		if err != nil {
-			return errors.Wrapf(err, "failed to set reconnect")
+			return errors.Wrapf(err, "failed to send initializing message %s", OutputMessageType(message.Type))
 		}
 	}
 
-	if wt.masterPrefs != nil {
-		err := wt.masterWrite(append([]byte{SetPreferences}, wt.masterPrefs...))
+	if wt.banner != nil {
+		banner := make([]byte, wt.outputEncoding.encodedLen(len(wt.banner)))
+		wt.outputEncoding.encode(banner, wt.banner)
+		err := wt.primaryWrite(Message{Output, banner})
 		if err != nil {
-			return errors.Wrapf(err, "failed to set preferences")
+			return errors.Wrapf(err, "failed to send banner")
 		}
 	}
 
 	return nil
 }
 
+// initializeMessages returns messages to initialize a master.
+// Messages only for the master such as compression negotiation
+// are included when primary is true.
+func (wt *WebTTY) initializeMessages(primary bool) ([]Message, error) {
+	settings := wt.currentRunSettings()
+
+	messages := []Message{{SetWindowTitle, settings.windowTitle}}
+
+	if settings.reconnect > 0 {
+		reconnect, _ := json.Marshal(settings.reconnect)
+		messages = append(messages, Message{SetReconnect, reconnect})
+	}
+
+	if wt.reconnectPolicy != nil {
+		policy, _ := json.Marshal(wt.reconnectPolicy)
+		messages = append(messages, Message{SetReconnectPolicy, policy})
+	}
+
+	if primary && wt.reattach {
+		token, _ := json.Marshal(wt.reconnectToken)
+		messages = append(messages, Message{SetReconnectToken, token})
+	}
+
+	if primary && wt.compression != nil {
+		messages = append(messages, Message{SetCompression, []byte(compressionDeflate)})
+	}
+
+	prefs := settings.masterPrefs
+	if prefs == nil && settings.preferences != nil {
+		var err error
+		prefs, err = json.Marshal(settings.preferences.withDefaults())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to marshal preferences as JSON")
+		}
+	}
+	if prefs != nil {
+		messages = append(messages, Message{SetPreferences, prefs})
+	}
+
+	if wt.clientConfig != nil {
+		messages = append(messages, Message{SetClientConfig, wt.clientConfig})
+	}
+
+	if settings.columns != 0 || settings.rows != 0 {
+		size, _ := json.Marshal(WindowSize{Columns: settings.columns, Rows: settings.rows})
+		messages = append(messages, Message{SetWindowSize, size})
+	}
+
+	if primary {
+		info, _ := json.Marshal(wt.protocolInfo())
+		messages = append(messages, Message{SetProtocolInfo, info})
+	}
+
+	return messages, nil
+}
+
+// sendInitialInput writes the initial input to the slave
+// on the first call when writing is permitted.
+func (wt *WebTTY) sendInitialInput() error {
+	wt.stateMutex.Lock()
+	send := wt.initialInput != nil && !wt.initialInputSent && wt.permitWrite && !wt.outputOnly
+	wt.initialInputSent = true
+	wt.stateMutex.Unlock()
+
+	if !send {
+		return nil
+	}
+
+	return wt.slaveWrite(wt.initialInput)
+}
+
 func (wt *WebTTY) handleSlaveReadEvent(data []byte) error {
-	safeMessage := base64.StdEncoding.EncodeToString(data)
-	err := wt.masterWrite(append([]byte{Output}, []byte(safeMessage)...))
+	if wt.quotaExceeded() {
+		return ErrQuotaExceeded
+	}
+
+	if wt.initialResizeDelay > 0 {
+		wt.releaseInitialResize()
+	}
+
+	data = applyTransforms(wt.outputTransforms, data)
+	if len(data) == 0 {
+		return nil
+	}
+
+	if wt.outputTee != nil {
+		wt.teeOutput(data)
+	}
+
+	if wt.osc != nil {
+		err := wt.handleOSC(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if wt.sizeQueries != nil {
+		wt.answerSizeQueries(data)
+	}
+
+	if wt.keepIfPaused(data) {
+		return nil
+	}
+
+	if wt.coalescer != nil {
+		return wt.coalesceOutput(data)
+	}
+
+	return wt.sendOutput(data)
+}
+
+// teeOutput writes output of the slave to the output tee.
+// The tee is given up after logging the first error.
+func (wt *WebTTY) teeOutput(data []byte) {
+	if wt.outputTeeFailed {
+		return
+	}
+
+	_, err := wt.outputTee.Write(data)
+	if err != nil {
+		wt.outputTeeFailed = true
+		log.Printf("Stopped writing output to tee: %s (session %s)", err, wt.sessionID)
+	}
+}
+
+// sendOutput sends output of the slave to the master,
+// split into messages within the max frame size.
+func (wt *WebTTY) sendOutput(data []byte) error {
+	limit := wt.maxOutputChunk()
+	for limit > 0 && len(data) > limit {
+		err := wt.sendOutputFrame(data[:limit])
+		if err != nil {
+			return err
+		}
+		data = data[limit:]
+	}
+	return wt.sendOutputFrame(data)
+}
+
+func (wt *WebTTY) sendOutputFrame(data []byte) error {
+	frame, err := wt.outputFrame(data)
+	if err != nil {
+		return err
+	}
+
+	wt.writeMutex.Lock()
+	if wt.scrollback != nil {
+		wt.scrollback.Write(data)
+	}
+	err = wt.masterWriteFrameLocked(*frame)
+	wt.writeMutex.Unlock()
 	if err != nil {
+		putFrame(frame)
 		return errors.Wrapf(err, "failed to send message to master")
 	}
 
+	wt.broadcastOutput(data, *frame)
+	putFrame(frame)
+
 	return nil
 }
 
-func (wt *WebTTY) masterWrite(data []byte) error {
+// masterWrite writes a message to the master and observers.
+func (wt *WebTTY) masterWrite(message Message) error {
+	return wt.writeMessage(message, true)
+}
+
+// primaryWrite writes a message only to the master, not to observers.
+func (wt *WebTTY) primaryWrite(message Message) error {
+	return wt.writeMessage(message, false)
+}
+
+func (wt *WebTTY) writeMessage(message Message, broadcast bool) error {
+	frame := getFrame(1 + len(message.Payload))
+	(*frame)[0] = message.Type
+	copy((*frame)[1:], message.Payload)
+	defer putFrame(frame)
+
+	err := wt.masterWriteFrame(*frame)
+	if err != nil {
+		return err
+	}
+
+	if broadcast {
+		wt.broadcastFrame(*frame)
+	}
+	return nil
+}
+
+// masterWriteFrame writes an encoded message to the master.
+func (wt *WebTTY) masterWriteFrame(frame []byte) error {
 	wt.writeMutex.Lock()
 	defer wt.writeMutex.Unlock()
 
-	_, err := wt.masterConn.Write(data)
+	return wt.masterWriteFrameLocked(frame)
+}
+
+// masterWriteFrameLocked works like masterWriteFrame with writeMutex held.
+// While the master is detached, messages are dropped.
+func (wt *WebTTY) masterWriteFrameLocked(frame []byte) error {
+	if wt.detached {
+		return nil
+	}
+
+	err := wt.writeFrameLocked(frame)
+	if err != nil && wt.reattach {
+		wt.detachLocked(atomic.LoadInt64(&wt.attachGeneration))
+		return nil
+	}
+
+	return err
+}
+
+// writeFrameLocked writes an encoded message to the master
+// with writeMutex held.
+func (wt *WebTTY) writeFrameLocked(frame []byte) error {
+	n, err := wt.writeToMaster(wt.connFor(frame[0]), frame)
+	atomic.AddInt64(&wt.stats.BytesToMaster, int64(n))
+	wt.observeBytes(DirectionToMaster, n)
+	wt.consumeQuota(n)
 	if err != nil {
-		return errors.Wrapf(err, "failed to write to master")
+		return &MasterError{Op: "write to", Err: err}
 	}
+	atomic.AddInt64(&wt.stats.FramesToMaster, 1)
+	wt.observeFrame(DirectionToMaster, frame)
 
 	return nil
 }
 
-func (wt *WebTTY) handleMasterReadEvent(data []byte) error {
+// InjectInput writes data to the slave as if it's input from the master.
+// It passes through transforms given by WithTransformPipeline as input
+// from the master does, and nothing is written when they drop it.
+// Returns ErrWriteNotPermitted when writing to the slave is not permitted.
+func (wt *WebTTY) InjectInput(data []byte) error {
+	if !wt.writePermitted() {
+		return ErrWriteNotPermitted
+	}
+
+	data = applyTransforms(wt.inputTransforms, append([]byte(nil), data...))
 	if len(data) == 0 {
-		return errors.New("unexpected zero length read from master")
+		return nil
 	}
 
-	switch data[0] {
-	case Input:
-		if !wt.permitWrite {
-			return nil
+	err := wt.slaveWrite(data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write injected data to slave")
+	}
+
+	return nil
+}
+
+// interrupt is the byte written by Interrupt, Ctrl-C.
+var interrupt = []byte{0x03}
+
+// Interrupt writes Ctrl-C to the slave to interrupt the running command
+// without closing the session.
+// It passes through transforms given by WithTransformPipeline as input
+// from the master does, and nothing is written when they drop it.
+// Returns ErrWriteNotPermitted when writing to the slave is not permitted.
+func (wt *WebTTY) Interrupt() error {
+	if !wt.writePermitted() {
+		return ErrWriteNotPermitted
+	}
+
+	data := applyTransforms(wt.inputTransforms, append([]byte(nil), interrupt...))
+	if len(data) == 0 {
+		return nil
+	}
+
+	log.Printf("Interrupting the slave (session %s)", wt.sessionID)
+	err := wt.slaveWrite(data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write interrupt to slave")
+	}
+
+	return nil
+}
+
+// slaveWrite writes all of data to the slave,
+// retrying the rest when the slave accepts only a part of it.
+func (wt *WebTTY) slaveWrite(data []byte) error {
+	slave := wt.currentSlave()
+	for len(data) > 0 {
+		n, err := wt.writeToSlave(slave, data)
+		atomic.AddInt64(&wt.stats.BytesToSlave, int64(n))
+		wt.observeBytes(DirectionToSlave, n)
+		wt.consumeQuota(n)
+		if err != nil {
+			return &SlaveError{Op: "write to", Err: err}
 		}
+		if n == 0 {
+			return &SlaveError{Op: "write to", Err: io.ErrShortWrite}
+		}
+		data = data[n:]
+	}
+	atomic.AddInt64(&wt.stats.FramesToSlave, 1)
 
-		if len(data) <= 1 {
-			return nil
+	return nil
+}
+
+// ResizeTerminal sets the size of the terminal of the slave
+// as resizing requested by the master.
+// The size is clamped to the valid range, and fixed columns and rows
+// given by WithFixedColumns and WithFixedRows are kept.
+func (wt *WebTTY) ResizeTerminal(columns int, rows int) error {
+	_, err := wt.resizeTerminal(columns, rows)
+	return err
+}
+
+// resizeTerminal works like ResizeTerminal, and returns the size applied to the slave.
+func (wt *WebTTY) resizeTerminal(columns int, rows int) (terminalSize, error) {
+	wt.stateMutex.Lock()
+	if wt.columns != 0 {
+		columns = wt.columns
+	}
+	if wt.rows != 0 {
+		rows = wt.rows
+	}
+	columns = clampTerminalSize(columns)
+	rows = clampTerminalSize(rows)
+	size := terminalSize{columns: columns, rows: rows}
+	wt.terminalSize = size
+	slave := wt.slave
+	wt.stateMutex.Unlock()
+
+	err := slave.ResizeTerminal(columns, rows)
+	if err != nil {
+		return size, errors.Wrapf(err, "failed to resize terminal to %dx%d", columns, rows)
+	}
+
+	return size, nil
+}
+
+// applyResize resizes the terminal as requested by the master,
+// and acknowledges it when the master has enabled ResizeAck.
+// Failing to resize isn't an error, the session goes on with the previous size.
+func (wt *WebTTY) applyResize(size terminalSize) error {
+	applied, err := wt.resizeTerminal(size.columns, size.rows)
+	if err != nil {
+		log.Printf("Failed to resize terminal: %s (session %s)", err, wt.sessionID)
+		return nil
+	}
+
+	if wt.resizeAckEnabled() {
+		ack, _ := json.Marshal(WindowSize{Columns: applied.columns, Rows: applied.rows})
+		err = wt.primaryWrite(Message{ResizeAck, ack})
+		if err != nil {
+			return errors.Wrapf(err, "failed to send ResizeAck message to master")
 		}
+	}
 
-		_, err := wt.slave.Write(data[1:])
+	return nil
+}
+
+// TerminalSize returns the last size of the terminal set to the slave,
+// or zeros when it's never resized.
+func (wt *WebTTY) TerminalSize() (columns int, rows int) {
+	wt.stateMutex.RLock()
+	defer wt.stateMutex.RUnlock()
+	return wt.terminalSize.columns, wt.terminalSize.rows
+}
+
+// writeInput writes input from the master to the slave when permitted.
+// When the write fails, the master gets ServerClose,
+// and a SlaveError is returned.
+func (wt *WebTTY) writeInput(data []byte) error {
+	if wt.outputOnlyMode() {
+		wt.dropInputOnce.Do(func() {
+			log.Printf("Dropping input in output only mode (session %s)", wt.sessionID)
+		})
+		return nil
+	}
+
+	if !wt.writePermitted() {
+		return nil
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	if wt.quotaExceeded() {
+		return ErrQuotaExceeded
+	}
+
+	data = applyTransforms(wt.inputTransforms, data)
+	if len(data) == 0 {
+		return nil
+	}
+
+	input := normalizeNewlines(data, wt.inputNewline, &wt.inputPendingCR)
+	err := wt.slaveWrite(input)
+	if err != nil {
+		// the slave has probably exited, tell the master why the session ends.
+		// The exit status is left to the goroutine reading the slave,
+		// as waiting for it can block while the process is still alive.
+		wt.sendCloseNotice(ErrSlaveClosed.Error())
+	}
+	return err
+}
+
+func (wt *WebTTY) handleMasterReadEvent(data []byte) error {
+	wt.observeFrame(DirectionFromMaster, data)
+
+	message, err := DecodeMessage(data)
+	if err != nil {
+		return &ProtocolError{Err: err}
+	}
+
+	switch message.Type {
+	case Input:
+		return wt.writeInput(message.Payload)
+
+	case InputBase64:
+		input, err := base64.StdEncoding.DecodeString(string(message.Payload))
 		if err != nil {
-			return errors.Wrapf(err, "failed to write received data to slave")
+			log.Printf("Ignoring malformed base64 input: %s (session %s)", err, wt.sessionID)
+			return nil
 		}
 
+		return wt.writeInput(input)
+
 	case Ping:
-		err := wt.masterWrite([]byte{Pong})
+		atomic.AddInt64(&wt.stats.Pings, 1)
+		wt.incPing()
+		// echo the payload such as a timestamp to measure round trip time
+		err := wt.primaryWrite(Message{Pong, message.Payload})
 		if err != nil {
 			return errors.Wrapf(err, "failed to return Pong message to master")
 		}
 
-	case ResizeTerminal:
-		if wt.columns != 0 && wt.rows != 0 {
+	case RequestRedraw:
+		return wt.redraw()
+
+	case SetClientInfo:
+		wt.handleClientInfo(message.Payload)
+
+	case AckCompression:
+		if wt.compression == nil {
 			break
 		}
+		wt.stateMutex.Lock()
+		wt.compressionAcked = true
+		wt.stateMutex.Unlock()
 
-		if len(data) <= 1 {
-			return errors.New("received malformed remote command for terminal resize: empty payload")
+	case ResizeTerminal:
+		if columns, rows := wt.fixedSize(); columns != 0 && rows != 0 {
+			break
 		}
 
-		var args argResizeTerminal
-		err := json.Unmarshal(data[1:], &args)
+		size, err := decodeResizeTerminal(message.Payload)
 		if err != nil {
-			return errors.Wrapf(err, "received malformed data for terminal resize")
-		}
-		rows := wt.rows
-		if rows == 0 {
-			rows = int(args.Rows)
+			return &ProtocolError{MessageType: MessageType(message.Type), Err: err}
 		}
 
-		columns := wt.columns
-		if columns == 0 {
-			columns = int(args.Columns)
+		if wt.holdInitialResize(size) {
+			break
 		}
+		return wt.applyResize(size)
 
-		wt.slave.ResizeTerminal(columns, rows)
 	default:
-		return errors.Errorf("unknown message type `%c`", data[0])
+		if wt.ignoreUnknownMessages {
+			log.Printf("Ignoring unknown message type %s (session %s)", MessageType(message.Type), wt.sessionID)
+			return nil
+		}
+		return &ProtocolError{MessageType: MessageType(message.Type), Err: errors.New("unknown message type")}
 	}
 
 	return nil
 }
 
-type argResizeTerminal struct {
-	Columns float64
-	Rows    float64
+// generateSessionID returns a random UUID (version 4).
+func generateSessionID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
 }
@@ -4,9 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"io"
+	"net"
+	"reflect"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yudai/gotty/webtty/webttytest"
 )
 
 type pipePair struct {
@@ -14,6 +24,147 @@ type pipePair struct {
 	*io.PipeWriter
 }
 
+type slavePipe struct {
+	pipePair
+}
+
+func (sp slavePipe) WindowTitleVariables() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (sp slavePipe) ResizeTerminal(columns int, rows int) error {
+	return nil
+}
+
+// testSession is a WebTTY running over pipes.
+type testSession struct {
+	dt *WebTTY
+
+	masterIn  *io.PipeWriter // sends messages to the WebTTY as the master
+	masterOut *io.PipeReader // receives messages from the WebTTY
+	slaveOut  *io.PipeWriter // emits output as the slave
+	slaveIn   *io.PipeReader // receives input written to the slave
+
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func newTestSession(t *testing.T, options ...Option) *testSession {
+	return newTestSessionWith(t, nil, nil, options...)
+}
+
+// newTestSessionWithSlave runs a WebTTY with a slave built by wrapping the pipes.
+func newTestSessionWithSlave(t *testing.T, wrapSlave func(slavePipe) Slave, options ...Option) *testSession {
+	return newTestSessionWith(t, nil, wrapSlave, options...)
+}
+
+// newTestSessionWith runs a WebTTY with a master and a slave built by wrapping the pipes.
+// nil wrappers use the pipes as they are.
+func newTestSessionWith(t *testing.T, wrapMaster func(pipePair) Master, wrapSlave func(slavePipe) Slave, options ...Option) *testSession {
+	if wrapMaster == nil {
+		wrapMaster = func(pp pipePair) Master { return pp }
+	}
+	if wrapSlave == nil {
+		wrapSlave = func(sp slavePipe) Slave { return sp }
+	}
+
+	connInPipeReader, connInPipeWriter := io.Pipe()
+	connOutPipeReader, connOutPipeWriter := io.Pipe()
+	slaveOutPipeReader, slaveOutPipeWriter := io.Pipe()
+	slaveInPipeReader, slaveInPipeWriter := io.Pipe()
+
+	dt, err := New(
+		wrapMaster(pipePair{connOutPipeReader, connInPipeWriter}),
+		wrapSlave(slavePipe{pipePair{slaveOutPipeReader, slaveInPipeWriter}}),
+		options...,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := &testSession{
+		dt:        dt,
+		masterIn:  connOutPipeWriter,
+		masterOut: connInPipeReader,
+		slaveOut:  slaveOutPipeWriter,
+		slaveIn:   slaveInPipeReader,
+		cancel:    cancel,
+		done:      make(chan error, 1),
+	}
+	go func() {
+		ts.done <- dt.Run(ctx)
+	}()
+
+	return ts
+}
+
+// readFrame reads a message written to the master.
+func (ts *testSession) readFrame(t *testing.T) []byte {
+	buf := make([]byte, 1024*1024)
+	n, err := ts.masterOut.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read(): %s", err)
+	}
+	return buf[:n]
+}
+
+// readInit reads the initializing messages, which end with SetProtocolInfo.
+func (ts *testSession) readInit(t *testing.T) [][]byte {
+	var frames [][]byte
+	for {
+		frame := ts.readFrame(t)
+		frames = append(frames, frame)
+		if frame[0] == SetProtocolInfo {
+			return frames
+		}
+	}
+}
+
+// readSlaveInput reads data written to the slave.
+func (ts *testSession) readSlaveInput(t *testing.T) []byte {
+	buf := make([]byte, 1024*1024)
+	n, err := ts.slaveIn.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read(): %s", err)
+	}
+	return buf[:n]
+}
+
+// close cancels Run and waits for it to return,
+// reading messages from the master until ServerClose.
+func (ts *testSession) close(t *testing.T) {
+	ts.cancel()
+	go func() {
+		buf := make([]byte, 1024*1024)
+		for {
+			n, err := ts.masterOut.Read(buf)
+			if err != nil || (n > 0 && buf[0] == ServerClose) {
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-ts.done:
+		if err != context.Canceled {
+			t.Errorf("Unexpected error from Run(): %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Run() did not return after cancel")
+	}
+}
+
+// waitFor polls cond until it's satisfied or a second passes.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for a condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func TestWriteFromPTY(t *testing.T) {
 	connInPipeReader, connInPipeWriter := io.Pipe() // in to conn
 	connOutPipeReader, _ := io.Pipe()               // out from conn
@@ -22,7 +173,16 @@ func TestWriteFromPTY(t *testing.T) {
 		connOutPipeReader,
 		connInPipeWriter,
 	}
-	dt, err := New(conn)
+
+	slaveOutPipeReader, slaveOutPipeWriter := io.Pipe() // out from slave
+	_, slaveInPipeWriter := io.Pipe()                   // in to slave
+
+	slave := slavePipe{pipePair{
+		slaveOutPipeReader,
+		slaveInPipeWriter,
+	}}
+
+	dt, err := New(conn, slave)
 	if err != nil {
 		t.Fatalf("Unexpected error from New(): %s", err)
 	}
@@ -31,15 +191,25 @@ func TestWriteFromPTY(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		wg.Done()
+		defer wg.Done()
 		err := dt.Run(ctx)
-		if err != nil {
-			t.Fatalf("Unexpected error from Run(): %s", err)
+		if err != context.Canceled {
+			t.Errorf("Unexpected error from Run(): %s", err)
 		}
 	}()
 
+	buf := make([]byte, 1024)
+
+	// window title and protocol info
+	for i := 0; i < 2; i++ {
+		_, err = connInPipeReader.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read(): %s", err)
+		}
+	}
+
 	message := []byte("foobar")
-	n, err := dt.TTY().Write(message)
+	n, err := slaveOutPipeWriter.Write(message)
 	if err != nil {
 		t.Fatalf("Unexpected error from Write(): %s", err)
 	}
@@ -47,7 +217,6 @@ func TestWriteFromPTY(t *testing.T) {
 		t.Fatalf("Write() accepted `%d` for message `%s`", n, message)
 	}
 
-	buf := make([]byte, 1024)
 	n, err = connInPipeReader.Read(buf)
 	if err != nil {
 		t.Fatalf("Unexpected error from Read(): %s", err)
@@ -65,6 +234,16 @@ func TestWriteFromPTY(t *testing.T) {
 	}
 
 	cancel()
+
+	// close notice
+	n, err = connInPipeReader.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read(): %s", err)
+	}
+	if buf[0] != ServerClose {
+		t.Fatalf("Unexpected message type `%c`", buf[0])
+	}
+
 	wg.Wait()
 }
 
@@ -77,7 +256,15 @@ func TestWriteFromConn(t *testing.T) {
 		connInPipeWriter,
 	}
 
-	dt, err := New(conn)
+	slaveOutPipeReader, _ := io.Pipe()                // out from slave
+	slaveInPipeReader, slaveInPipeWriter := io.Pipe() // in to slave
+
+	slave := slavePipe{pipePair{
+		slaveOutPipeReader,
+		slaveInPipeWriter,
+	}}
+
+	dt, err := New(conn, slave, WithPermitWrite())
 	if err != nil {
 		t.Fatalf("Unexpected error from New(): %s", err)
 	}
@@ -86,10 +273,10 @@ func TestWriteFromConn(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		wg.Done()
+		defer wg.Done()
 		err := dt.Run(ctx)
-		if err != nil {
-			t.Fatalf("Unexpected error from Run(): %s", err)
+		if err != context.Canceled {
+			t.Errorf("Unexpected error from Run(): %s", err)
 		}
 	}()
 
@@ -99,8 +286,16 @@ func TestWriteFromConn(t *testing.T) {
 	)
 	readBuf := make([]byte, 1024)
 
+	// window title and protocol info
+	for i := 0; i < 2; i++ {
+		_, err = connInPipeReader.Read(readBuf)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read(): %s", err)
+		}
+	}
+
 	// input
-	message = []byte("0hello\n") // line buffered canonical mode
+	message = []byte("1hello\n") // line buffered canonical mode
 	n, err = connOutPipeWriter.Write(message)
 	if err != nil {
 		t.Fatalf("Unexpected error from Write(): %s", err)
@@ -109,16 +304,16 @@ func TestWriteFromConn(t *testing.T) {
 		t.Fatalf("Write() accepted `%d` for message `%s`", n, message)
 	}
 
-	n, err = dt.TTY().Read(readBuf)
+	n, err = slaveInPipeReader.Read(readBuf)
 	if err != nil {
-		t.Fatalf("Unexpected error from Write(): %s", err)
+		t.Fatalf("Unexpected error from Read(): %s", err)
 	}
 	if !bytes.Equal(readBuf[:n], message[1:]) {
 		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
 	}
 
 	// ping
-	message = []byte("1\n") // line buffered canonical mode
+	message = []byte{Ping}
 	n, err = connOutPipeWriter.Write(message)
 	if n != len(message) {
 		t.Fatalf("Write() accepted `%d` for message `%s`", n, message)
@@ -128,12 +323,2416 @@ func TestWriteFromConn(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error from Read(): %s", err)
 	}
-	if !bytes.Equal(readBuf[:n], []byte{'1'}) {
+	if !bytes.Equal(readBuf[:n], []byte{Pong}) {
 		t.Fatalf("Unexpected message received: `%s`", readBuf[:n])
 	}
 
 	// TODO: resize
 
 	cancel()
+
+	// close notice
+	n, err = connInPipeReader.Read(readBuf)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read(): %s", err)
+	}
+	if readBuf[0] != ServerClose {
+		t.Fatalf("Unexpected message type `%c`", readBuf[0])
+	}
+
+	wg.Wait()
+}
+
+func TestSessionID(t *testing.T) {
+	dt1, err := New(pipePair{}, slavePipe{})
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	dt2, err := New(pipePair{}, slavePipe{})
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	if dt1.SessionID() == "" {
+		t.Fatalf("Session ID is not generated")
+	}
+	if dt1.SessionID() == dt2.SessionID() {
+		t.Fatalf("Generated session IDs are not unique: `%s`", dt1.SessionID())
+	}
+
+	dt3, err := New(pipePair{}, slavePipe{}, WithSessionID("foobar"))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	if dt3.SessionID() != "foobar" {
+		t.Fatalf("Unexpected session ID: `%s`", dt3.SessionID())
+	}
+}
+
+func TestStats(t *testing.T) {
+	ts := newTestSession(t, WithPermitWrite(), WithWindowTitle([]byte("title")))
+	defer ts.close(t)
+
+	info := ts.readInit(t)[1]
+
+	ts.slaveOut.Write([]byte("foobar"))
+	ts.readFrame(t)
+
+	ts.masterIn.Write([]byte{Input, 'h', 'e', 'l', 'l', 'o'})
+	ts.readSlaveInput(t)
+
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+
+	expected := Stats{
+		BytesToMaster:  int64(6 + len(info) + 9 + 1),
+		BytesToSlave:   5,
+		FramesToMaster: 4,
+		FramesToSlave:  1,
+		Pings:          1,
+	}
+	waitFor(t, func() bool { return ts.dt.Stats() == expected })
+}
+
+type metricsRecorder struct {
+	mutex sync.Mutex
+	bytes map[string]int
+	pings int
+}
+
+func (mr *metricsRecorder) ObserveBytes(direction string, n int) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.bytes[direction] += n
+}
+
+func (mr *metricsRecorder) IncPing() {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.pings++
+}
+
+func (mr *metricsRecorder) get() (int, int, int) {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	return mr.bytes[DirectionToMaster], mr.bytes[DirectionToSlave], mr.pings
+}
+
+func TestMetricsObserver(t *testing.T) {
+	mr := &metricsRecorder{bytes: map[string]int{}}
+	ts := newTestSession(t, WithPermitWrite(), WithMetricsObserver(mr))
+	defer ts.close(t)
+
+	info := ts.readInit(t)[1]
+
+	ts.slaveOut.Write([]byte("foobar"))
+	ts.readFrame(t)
+
+	ts.masterIn.Write([]byte{Input, 'h', 'e', 'l', 'l', 'o'})
+	ts.readSlaveInput(t)
+
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+
+	waitFor(t, func() bool {
+		toMaster, toSlave, pings := mr.get()
+		return toMaster == 1+len(info)+9+1 && toSlave == 5 && pings == 1
+	})
+}
+
+func TestLastActivity(t *testing.T) {
+	ts := newTestSession(t, WithPermitWrite())
+	defer ts.close(t)
+
+	ts.readInit(t)
+	start := ts.dt.LastActivity()
+
+	// read while traffic flows
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				ts.dt.LastActivity()
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Millisecond)
+		go ts.slaveOut.Write([]byte("foo"))
+		ts.readFrame(t)
+		ts.masterIn.Write([]byte{Input, 'x'})
+		ts.readSlaveInput(t)
+	}
+	close(stop)
+	<-readerDone
+
+	if !ts.dt.LastActivity().After(start) {
+		t.Fatalf("LastActivity() didn't advance from %s", start)
+	}
+}
+
+func TestNilMetricsObserver(t *testing.T) {
+	ts := newTestSession(t, WithMetricsObserver(nil))
+	defer ts.close(t)
+
+	ts.readInit(t)
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+}
+
+// frameRecorder records frames passed to a frame observer.
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames map[string][][]byte
+}
+
+func (fr *frameRecorder) observe(direction string, frame []byte) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.frames[direction] = append(fr.frames[direction], frame)
+}
+
+// find returns the first frame of the type observed in the direction.
+func (fr *frameRecorder) find(direction string, messageType byte) []byte {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	for _, frame := range fr.frames[direction] {
+		if frame[0] == messageType {
+			return frame
+		}
+	}
+	return nil
+}
+
+func TestFrameObserver(t *testing.T) {
+	fr := &frameRecorder{frames: map[string][][]byte{}}
+	ts := newTestSession(t, WithPermitWrite(), WithFrameObserver(fr.observe))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	ts.slaveOut.Write([]byte("foobar"))
+	ts.readFrame(t)
+
+	ts.masterIn.Write([]byte{Input, 'h', 'i'})
+	ts.readSlaveInput(t)
+
+	waitFor(t, func() bool {
+		output := fr.find(DirectionToMaster, Output)
+		input := fr.find(DirectionFromMaster, Input)
+		return bytes.Equal(output, append([]byte{Output}, "Zm9vYmFy"...)) &&
+			bytes.Equal(input, []byte{Input, 'h', 'i'})
+	})
+}
+
+func TestPreferences(t *testing.T) {
+	prefs := Preferences{
+		FontFamily:  "monospace",
+		FontSize:    14,
+		CursorShape: "BEAM",
+		CursorBlink: true,
+	}
+	ts := newTestSession(t, WithPreferences(prefs))
+	defer ts.close(t)
+
+	frame := ts.readInit(t)[1]
+	if frame[0] != SetPreferences {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+	var received Preferences
+	err := json.Unmarshal(frame[1:], &received)
+	if err != nil {
+		t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+	}
+	if received != prefs {
+		t.Fatalf("Unexpected preferences received: `%s`", frame[1:])
+	}
+}
+
+func TestPreferencesDefaults(t *testing.T) {
+	ts := newTestSession(t, WithPreferences(Preferences{FontSize: 20}))
+	defer ts.close(t)
+
+	frame := ts.readInit(t)[1]
+	var received Preferences
+	err := json.Unmarshal(frame[1:], &received)
+	if err != nil {
+		t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+	}
+	expected := DefaultPreferences
+	expected.FontSize = 20
+	if received != expected {
+		t.Fatalf("Unexpected preferences received: `%s`", frame[1:])
+	}
+}
+
+func TestMasterPreferencesNotMerged(t *testing.T) {
+	ts := newTestSession(t, WithPreferences(Preferences{FontSize: 20}), WithMasterPreferences(map[string]int{"font-size": 12}))
+	defer ts.close(t)
+
+	frame := ts.readInit(t)[1]
+	if !bytes.Equal(frame, append([]byte{SetPreferences}, `{"font-size":12}`...)) {
+		t.Fatalf("Unexpected preferences received: `%s`", frame[1:])
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	ts := newTestSession(t, WithClientConfig(map[string]interface{}{"reconnect": true, "clipboard": false, "upload_limit": 1024}))
+	defer ts.close(t)
+
+	var config map[string]interface{}
+	for _, frame := range ts.readInit(t) {
+		if frame[0] == SetClientConfig {
+			err := json.Unmarshal(frame[1:], &config)
+			if err != nil {
+				t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+			}
+		}
+	}
+	expected := map[string]interface{}{"reconnect": true, "clipboard": false, "upload_limit": float64(1024)}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("Unexpected client config received: %v", config)
+	}
+
+	_, err := New(pipePair{}, slavePipe{}, WithClientConfig(map[string]interface{}{"invalid": func() {}}))
+	if err == nil {
+		t.Fatalf("Expected an error for a config not marshaled")
+	}
+}
+
+func TestWindowSize(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		options  []Option
+		expected []byte
+	}{
+		{name: "fixed", options: []Option{WithFixedColumns(80), WithFixedRows(24)}, expected: []byte(`{"columns":80,"rows":24}`)},
+		{name: "fixed rows", options: []Option{WithFixedRows(24)}, expected: []byte(`{"columns":0,"rows":24}`)},
+		{name: "dynamic", options: nil, expected: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestSession(t, tc.options...)
+			defer ts.close(t)
+
+			var size []byte
+			for _, frame := range ts.readInit(t) {
+				if frame[0] == SetWindowSize {
+					size = frame[1:]
+				}
+			}
+			if !bytes.Equal(size, tc.expected) {
+				t.Fatalf("Unexpected window size: `%s`", size)
+			}
+		})
+	}
+}
+
+func TestSetWindowTitle(t *testing.T) {
+	ts := newTestSession(t, WithWindowTitle([]byte("foo")))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ts.dt.SetWindowTitle("bar")
+	}()
+
+	frame := ts.readFrame(t)
+	if !bytes.Equal(frame, []byte{SetWindowTitle, 'b', 'a', 'r'}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error from SetWindowTitle(): %s", err)
+	}
+}
+
+func TestSetPermitWrite(t *testing.T) {
+	ts := newTestSession(t, WithPermitWrite())
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	go io.Copy(io.Discard, ts.slaveIn)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ts.dt.SetPermitWrite(i%2 == 0)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ts.masterIn.Write([]byte{Input, 'a'})
+	}
 	wg.Wait()
+
+	ts.dt.SetPermitWrite(false)
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+	written := ts.dt.Stats().FramesToSlave
+
+	ts.masterIn.Write([]byte{Input, 'b'})
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+	if ts.dt.Stats().FramesToSlave != written {
+		t.Fatalf("Input is written to the slave after write permission is revoked")
+	}
+
+	ts.dt.SetPermitWrite(true)
+	ts.masterIn.Write([]byte{Input, 'c'})
+	waitFor(t, func() bool { return ts.dt.Stats().FramesToSlave == written+1 })
+}
+
+func TestNotify(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ts.dt.Notify("maintenance in 5 minutes")
+	}()
+
+	frame := ts.readFrame(t)
+	if frame[0] != ServerMessage {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+	var text string
+	err := json.Unmarshal(frame[1:], &text)
+	if err != nil {
+		t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+	}
+	if text != "maintenance in 5 minutes" {
+		t.Fatalf("Unexpected message received: `%s`", text)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error from Notify(): %s", err)
+	}
+}
+
+type exitSlave struct {
+	slavePipe
+	code int
+}
+
+func (es exitSlave) ExitStatus() int {
+	return es.code
+}
+
+func TestExitStatus(t *testing.T) {
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		return exitSlave{sp, 42}
+	})
+
+	ts.readInit(t)
+
+	ts.slaveOut.Close()
+
+	frame := ts.readFrame(t)
+	if !bytes.Equal(frame, []byte{Exit, '4', '2'}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+
+	err := <-ts.done
+	exitErr, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("Unexpected error from Run(): %s", err)
+	}
+	if exitErr.ExitCode() != 42 {
+		t.Fatalf("Unexpected exit code: %d", exitErr.ExitCode())
+	}
+	if errors.Cause(err) != ErrSlaveClosed {
+		t.Fatalf("Unexpected cause of error: %s", errors.Cause(err))
+	}
+}
+
+// resizeSlave records resizing with the number of messages
+// sent to the master at the time.
+type resizeSlave struct {
+	slavePipe
+	dt      **WebTTY
+	resizes chan [3]int
+}
+
+func (rs resizeSlave) ResizeTerminal(columns int, rows int) error {
+	rs.resizes <- [3]int{columns, rows, int((*rs.dt).Stats().FramesToMaster)}
+	return nil
+}
+
+func TestResizeOnConnect(t *testing.T) {
+	var dt *WebTTY
+	resizes := make(chan [3]int, 1)
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		return resizeSlave{sp, &dt, resizes}
+	})
+	dt = ts.dt
+	defer ts.close(t)
+
+	// sent before the initializing messages are read
+	go ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":120,"rows":40}`...))
+
+	frames := ts.readInit(t)
+	select {
+	case resize := <-resizes:
+		if resize != [3]int{120, 40, len(frames)} {
+			t.Fatalf("Unexpected resizing: %v", resize)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The slave was not resized")
+	}
+}
+
+// blockingExitSlave blocks in ExitStatus until the process exits,
+// which never happens.
+type blockingExitSlave struct {
+	slavePipe
+}
+
+func (bs blockingExitSlave) ExitStatus() int {
+	select {}
+}
+
+func TestSlaveWriteError(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		slave func(sp slavePipe) Slave
+	}{
+		{name: "exit status", slave: func(sp slavePipe) Slave { return exitSlave{sp, 1} }},
+		{name: "no exit status", slave: func(sp slavePipe) Slave { return exitSlave{sp, -1} }},
+		// the exit status isn't waited for on writing
+		{name: "process alive", slave: func(sp slavePipe) Slave { return blockingExitSlave{sp} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestSessionWithSlave(t, tc.slave, WithPermitWrite())
+			defer ts.cancel()
+
+			ts.readInit(t)
+			ts.slaveIn.CloseWithError(errors.New("process exited"))
+			ts.masterIn.Write([]byte{Input, 'l', 's'})
+
+			if frame := ts.readFrame(t); !bytes.Equal(frame, append([]byte{ServerClose}, `"slave closed"`...)) {
+				t.Fatalf("Unexpected message received: `%s`", frame)
+			}
+			select {
+			case err := <-ts.done:
+				if errors.Cause(err) != ErrSlaveClosed {
+					t.Fatalf("Unexpected error from Run(): %s", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Run() did not return after the write error")
+			}
+		})
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	ts := newTestSession(t, WithDrainTimeout(time.Minute))
+
+	ts.readInit(t)
+
+	// the last output written just before canceling
+	go ts.slaveOut.Write([]byte("bye"))
+	ts.cancel()
+
+	frame := ts.readFrame(t)
+	if !bytes.Equal(frame, append([]byte{Output}, base64.StdEncoding.EncodeToString([]byte("bye"))...)) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+
+	// returns without waiting for the whole timeout
+	if frame := ts.readFrame(t); frame[0] != ServerClose {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	select {
+	case err := <-ts.done:
+		if err != context.Canceled {
+			t.Fatalf("Unexpected error from Run(): %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return after draining")
+	}
+}
+
+func TestDrainTimeoutFlushesCoalesced(t *testing.T) {
+	ts := newTestSession(t, WithDrainTimeout(time.Minute), WithOutputCoalesce(time.Hour, 1024))
+
+	ts.readInit(t)
+	ts.slaveOut.Write([]byte("bye"))
+	ts.cancel()
+
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("bye")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+	ts.readFrame(t) // ServerClose
+	if err := ts.runError(t); err != context.Canceled {
+		t.Fatalf("Unexpected error from Run(): %s", err)
+	}
+}
+
+func TestDrainTimeoutBounded(t *testing.T) {
+	ts := newTestSession(t, WithDrainTimeout(10*time.Millisecond))
+
+	ts.readInit(t)
+
+	ts.cancel()
+	if frame := ts.readFrame(t); frame[0] != ServerClose {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	select {
+	case err := <-ts.done:
+		if err != context.Canceled {
+			t.Fatalf("Unexpected error from Run(): %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return after the drain timeout")
+	}
+}
+
+type contextSlave struct {
+	slavePipe
+}
+
+func (cs contextSlave) Read(p []byte) (int, error) {
+	select {}
+}
+
+func (cs contextSlave) ReadContext(ctx context.Context, p []byte) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestContextReader(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		return contextSlave{sp}
+	})
+
+	ts.readInit(t)
+	ts.close(t)
+
+	// stop reading the master
+	ts.masterIn.Close()
+
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+// zeroReadMaster returns (0, nil) on every other read.
+type zeroReadMaster struct {
+	pipePair
+	reads *int
+}
+
+func (zm zeroReadMaster) Read(p []byte) (int, error) {
+	*zm.reads++
+	if *zm.reads%2 == 1 {
+		return 0, nil
+	}
+	return zm.pipePair.Read(p)
+}
+
+func TestZeroLengthReadFromMaster(t *testing.T) {
+	ts := newTestSessionWith(t, func(pp pipePair) Master {
+		return zeroReadMaster{pp, new(int)}
+	}, nil)
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	for i := 0; i < 3; i++ {
+		ts.masterIn.Write([]byte{Ping})
+		frame := ts.readFrame(t)
+		if !bytes.Equal(frame, []byte{Pong}) {
+			t.Fatalf("Unexpected message received: `%s`", frame)
+		}
+	}
+}
+
+func TestUnknownMessage(t *testing.T) {
+	ts := newTestSession(t)
+
+	ts.readInit(t)
+	ts.masterIn.Write([]byte{'z'})
+
+	select {
+	case err := <-ts.done:
+		if err == nil || errors.Cause(err) == ErrMasterClosed {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return on an unknown message")
+	}
+}
+
+func TestIgnoreUnknownMessages(t *testing.T) {
+	ts := newTestSession(t, WithIgnoreUnknownMessages())
+	defer ts.close(t)
+
+	ts.readInit(t)
+	ts.masterIn.Write([]byte{'z'})
+	ts.masterIn.Write([]byte{Ping})
+
+	frame := ts.readFrame(t)
+	if !bytes.Equal(frame, []byte{Pong}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+}
+
+func decodeOutput(t *testing.T, frame []byte) []byte {
+	if frame[0] != Output {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(frame[1:]))
+	if err != nil {
+		t.Fatalf("Unexpected error from DecodeString(): %s", err)
+	}
+	return decoded
+}
+
+func TestOutputCoalesce(t *testing.T) {
+	ts := newTestSession(t, WithOutputCoalesce(100*time.Millisecond, 1024))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	for _, b := range []byte("foobar") {
+		ts.slaveOut.Write([]byte{b})
+	}
+
+	frame := ts.readFrame(t)
+	if output := decodeOutput(t, frame); !bytes.Equal(output, []byte("foobar")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+	// initializing messages and the coalesced output
+	waitFor(t, func() bool { return ts.dt.Stats().FramesToMaster == 3 })
+}
+
+func TestOutputCoalesceFlushedOnSlaveClose(t *testing.T) {
+	ts := newTestSession(t, WithOutputCoalesce(time.Hour, 1024))
+
+	ts.readInit(t)
+	ts.slaveOut.Write([]byte("bye"))
+	ts.slaveOut.Close()
+
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("bye")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+	select {
+	case err := <-ts.done:
+		if err != ErrSlaveClosed {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return after the slave is closed")
+	}
+}
+
+func TestOutputCoalesceFlushError(t *testing.T) {
+	ts := newTestSession(t, WithOutputCoalesce(10*time.Millisecond, 1024))
+	defer ts.cancel()
+
+	ts.readInit(t)
+	ts.masterOut.Close()
+	// the slave goes quiet after the output flushed by the timer
+	ts.slaveOut.Write([]byte("foo"))
+
+	if err := ts.runError(t); errors.Cause(err) != ErrMasterClosed {
+		t.Fatalf("Unexpected error from Run(): %v", err)
+	}
+}
+
+func (ts *testSession) coalescedOutput() string {
+	c := ts.dt.coalescer
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return string(c.pending)
+}
+
+func TestOutputCoalesceStoppedOnReturn(t *testing.T) {
+	ts := newTestSession(t, WithOutputCoalesce(50*time.Millisecond, 1024))
+
+	ts.readInit(t)
+	ts.slaveOut.Write([]byte("x"))
+	waitFor(t, func() bool { return ts.coalescedOutput() == "x" })
+
+	ts.cancel()
+	if frame := ts.readFrame(t); frame[0] != ServerClose {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	if err := <-ts.done; err != context.Canceled {
+		t.Fatalf("Unexpected error from Run(): %v", err)
+	}
+
+	frames := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, err := ts.masterOut.Read(buf)
+		if err == nil {
+			frames <- buf[:n]
+		}
+	}()
+	select {
+	case frame := <-frames:
+		t.Fatalf("Message sent after Run() returned: `%s`", frame)
+	case <-time.After(100 * time.Millisecond):
+	}
+	ts.masterOut.Close()
+}
+
+func TestOutputCoalesceMaxBytes(t *testing.T) {
+	ts := newTestSession(t, WithOutputCoalesce(time.Hour, 4))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	go func() {
+		for _, b := range []byte("foobar") {
+			ts.slaveOut.Write([]byte{b})
+		}
+	}()
+
+	frame := ts.readFrame(t)
+	if output := decodeOutput(t, frame); !bytes.Equal(output, []byte("foob")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+}
+
+type discardMaster struct{}
+
+func (discardMaster) Read(p []byte) (int, error) {
+	select {}
+}
+
+func (discardMaster) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func BenchmarkHandleSlaveReadEvent(b *testing.B) {
+	wt, err := New(discardMaster{}, slavePipe{})
+	if err != nil {
+		b.Fatalf("Unexpected error from New(): %s", err)
+	}
+	data := bytes.Repeat([]byte("x"), 1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := wt.handleSlaveReadEvent(data)
+		if err != nil {
+			b.Fatalf("Unexpected error from handleSlaveReadEvent(): %s", err)
+		}
+	}
+}
+
+// slowMaster blocks writes after the initializing messages until released.
+type slowMaster struct {
+	pipePair
+	writes  *int32
+	release chan struct{}
+}
+
+func (sm slowMaster) Write(p []byte) (int, error) {
+	if atomic.AddInt32(sm.writes, 1) > 2 {
+		<-sm.release
+	}
+	return sm.pipePair.Write(p)
+}
+
+func TestWriteQueueDepth(t *testing.T) {
+	release := make(chan struct{})
+	ts := newTestSessionWith(t, func(pp pipePair) Master {
+		return slowMaster{pp, new(int32), release}
+	}, nil, WithWriteQueueDepth(2))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	var written int32
+	go func() {
+		for i := 0; i < 10; i++ {
+			ts.slaveOut.Write([]byte{'a' + byte(i)})
+			atomic.AddInt32(&written, 1)
+		}
+	}()
+
+	// one chunk being written, two in the queue and one waiting for room
+	waitFor(t, func() bool { return atomic.LoadInt32(&written) == 4 })
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&written); n != 4 {
+		t.Fatalf("Reading the slave didn't pause, %d chunks read", n)
+	}
+
+	close(release)
+	for i := 0; i < 10; i++ {
+		frame := ts.readFrame(t)
+		if output := decodeOutput(t, frame); !bytes.Equal(output, []byte{'a' + byte(i)}) {
+			t.Fatalf("Unexpected output received: `%s`", output)
+		}
+	}
+}
+
+func TestWriteQueueExitStatus(t *testing.T) {
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		return exitSlave{sp, 1}
+	}, WithWriteQueueDepth(2))
+
+	ts.readInit(t)
+
+	ts.slaveOut.Write([]byte("bye"))
+	ts.slaveOut.Close()
+
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("bye")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+	if frame := ts.readFrame(t); !bytes.Equal(frame, []byte{Exit, '1'}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	if err := <-ts.done; errors.Cause(err) != ErrSlaveClosed {
+		t.Fatalf("Unexpected error from Run(): %s", err)
+	}
+}
+
+func TestWriteQueueCoalesceFlushedOnSlaveClose(t *testing.T) {
+	ts := newTestSession(t, WithWriteQueueDepth(2), WithOutputCoalesce(time.Hour, 1024))
+
+	ts.readInit(t)
+	ts.slaveOut.Write([]byte("bye"))
+	ts.slaveOut.Close()
+
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("bye")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+	select {
+	case err := <-ts.done:
+		if err != ErrSlaveClosed {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return after the slave is closed")
+	}
+}
+
+func TestStartWait(t *testing.T) {
+	connInPipeReader, connInPipeWriter := io.Pipe()
+	connOutPipeReader, _ := io.Pipe()
+	slaveOutPipeReader, slaveOutPipeWriter := io.Pipe()
+	_, slaveInPipeWriter := io.Pipe()
+
+	dt, err := New(
+		pipePair{connOutPipeReader, connInPipeWriter},
+		slavePipe{pipePair{slaveOutPipeReader, slaveInPipeWriter}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	if err := dt.Wait(); err != ErrNotStarted {
+		t.Fatalf("Unexpected error from Wait(): %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := dt.Start(ctx); err != nil {
+		t.Fatalf("Unexpected error from Start(): %s", err)
+	}
+	if err := dt.Start(ctx); err != ErrAlreadyStarted {
+		t.Fatalf("Unexpected error from the second Start(): %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	connInPipeReader.Read(buf) // window title
+	connInPipeReader.Read(buf) // protocol info
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			errs <- dt.Wait()
+		}()
+	}
+
+	slaveOutPipeWriter.Close()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrSlaveClosed {
+				t.Fatalf("Unexpected error from Wait(): %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Wait() did not return")
+		}
+	}
+}
+
+func TestInjectInput(t *testing.T) {
+	ts := newTestSession(t, WithPermitWrite())
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ts.dt.InjectInput([]byte("ls\r"))
+	}()
+
+	if input := ts.readSlaveInput(t); !bytes.Equal(input, []byte("ls\r")) {
+		t.Fatalf("Unexpected input received: `%s`", input)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error from InjectInput(): %s", err)
+	}
+
+	ts.dt.SetPermitWrite(false)
+	if err := ts.dt.InjectInput([]byte("ls\r")); err != ErrWriteNotPermitted {
+		t.Fatalf("Unexpected error from InjectInput(): %v", err)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	ts := newTestSession(t, WithPermitWrite())
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ts.dt.Interrupt()
+	}()
+
+	if input := ts.readSlaveInput(t); !bytes.Equal(input, []byte{0x03}) {
+		t.Fatalf("Unexpected input received: %q", input)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error from Interrupt(): %s", err)
+	}
+
+	ts.dt.SetPermitWrite(false)
+	if err := ts.dt.Interrupt(); err != ErrWriteNotPermitted {
+		t.Fatalf("Unexpected error from Interrupt(): %v", err)
+	}
+}
+
+// recordingSlave records data written to it.
+type recordingSlave struct {
+	slavePipe
+	mutex   *sync.Mutex
+	written *bytes.Buffer
+}
+
+func newRecordingSlave(sp slavePipe) recordingSlave {
+	return recordingSlave{sp, new(sync.Mutex), new(bytes.Buffer)}
+}
+
+func (rs recordingSlave) Write(p []byte) (int, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.written.Write(p)
+}
+
+func (rs recordingSlave) recorded() string {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.written.String()
+}
+
+// shortWriteSlave accepts at most 2 bytes in a write.
+type shortWriteSlave struct {
+	recordingSlave
+}
+
+func (sws shortWriteSlave) Write(p []byte) (int, error) {
+	if len(p) > 2 {
+		p = p[:2]
+	}
+	return sws.recordingSlave.Write(p)
+}
+
+func TestShortWriteToSlave(t *testing.T) {
+	var slave shortWriteSlave
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		slave = shortWriteSlave{newRecordingSlave(sp)}
+		return slave
+	}, WithPermitWrite())
+	defer ts.close(t)
+
+	ts.readInit(t)
+	ts.masterIn.Write([]byte{Input, 'h', 'e', 'l', 'l', 'o'})
+	ts.masterIn.Write([]byte{Input, 'w', 'o', 'r', 'l', 'd'})
+
+	waitFor(t, func() bool { return slave.recorded() == "helloworld" })
+	waitFor(t, func() bool { return ts.dt.Stats().FramesToSlave == 2 })
+}
+
+// replaceMaster gives the WebTTY a new master for the next run.
+// The master of the previous run is left to its reader.
+func (ts *testSession) replaceMaster() {
+	connInPipeReader, connInPipeWriter := io.Pipe()
+	connOutPipeReader, connOutPipeWriter := io.Pipe()
+
+	ts.dt.writeMutex.Lock()
+	ts.dt.masterConn = pipePair{connOutPipeReader, connInPipeWriter}
+	ts.dt.writeMutex.Unlock()
+	ts.masterIn = connOutPipeWriter
+	ts.masterOut = connInPipeReader
+}
+
+func TestRunWith(t *testing.T) {
+	var slave recordingSlave
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		slave = newRecordingSlave(sp)
+		return slave
+	})
+	ts.readInit(t)
+	ts.close(t)
+
+	run := func(input byte, options ...Option) {
+		ts.replaceMaster()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- ts.dt.RunWith(ctx, options...)
+		}()
+
+		ts.readInit(t)
+		ts.masterIn.Write([]byte{Input, input})
+		ts.masterIn.Write([]byte{Ping})
+		ts.readFrame(t)
+		time.Sleep(50 * time.Millisecond)
+
+		cancel()
+		ts.readFrame(t) // ServerClose
+		if err := <-done; err != context.Canceled {
+			t.Fatalf("Unexpected error from RunWith(): %s", err)
+		}
+	}
+
+	run('a', WithPermitWrite())
+	run('b')
+	if recorded := slave.recorded(); recorded != "a" {
+		t.Fatalf("Unexpected input written: `%s`", recorded)
+	}
+	if ts.dt.writePermitted() {
+		t.Fatalf("Writing is permitted after RunWith() returned")
+	}
+
+	// options only for New are rejected without changing the WebTTY
+	err := ts.dt.RunWith(context.Background(), WithPermitWrite(), WithCompression())
+	if err == nil {
+		t.Fatalf("Expected an error from RunWith() for an option only for New")
+	}
+	if ts.dt.writePermitted() || ts.dt.compression != nil {
+		t.Fatalf("The WebTTY is changed by rejected options")
+	}
+}
+
+func TestInitialInput(t *testing.T) {
+	var slave recordingSlave
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		slave = newRecordingSlave(sp)
+		return slave
+	}, WithPermitWrite(), WithInitialInput([]byte("top\n")))
+
+	ts.readInit(t)
+	waitFor(t, func() bool { return slave.recorded() == "top\n" })
+	ts.close(t)
+
+	// run again as a reconnect
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ts.dt.Run(ctx)
+
+	ts.readInit(t)
+	time.Sleep(50 * time.Millisecond)
+	if recorded := slave.recorded(); recorded != "top\n" {
+		t.Fatalf("Unexpected input written: `%s`", recorded)
+	}
+}
+
+func TestInitialInputNotPermitted(t *testing.T) {
+	var slave recordingSlave
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		slave = newRecordingSlave(sp)
+		return slave
+	}, WithInitialInput([]byte("top\n")))
+	defer ts.close(t)
+
+	ts.readInit(t)
+	time.Sleep(50 * time.Millisecond)
+	if recorded := slave.recorded(); recorded != "" {
+		t.Fatalf("Unexpected input written: `%s`", recorded)
+	}
+}
+
+// testObserver is an observer connected over pipes.
+type testObserver struct {
+	in  *io.PipeWriter // sends messages as the observer
+	out *io.PipeReader // receives messages for the observer
+}
+
+func addTestObserver(t *testing.T, dt *WebTTY) *testObserver {
+	inPipeReader, inPipeWriter := io.Pipe()
+	outPipeReader, outPipeWriter := io.Pipe()
+	to := &testObserver{in: inPipeWriter, out: outPipeReader}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- dt.AddObserver(pipePair{inPipeReader, outPipeWriter})
+	}()
+	to.readFrame(t) // window title
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error from AddObserver(): %s", err)
+	}
+
+	return to
+}
+
+func (to *testObserver) readFrame(t *testing.T) []byte {
+	buf := make([]byte, 1024)
+	n, err := to.out.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read(): %s", err)
+	}
+	return buf[:n]
+}
+
+type failingMaster struct{}
+
+func (failingMaster) Read(p []byte) (int, error) {
+	select {}
+}
+
+func (failingMaster) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestObservers(t *testing.T) {
+	var slave recordingSlave
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		slave = newRecordingSlave(sp)
+		return slave
+	}, WithPermitWrite())
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	observer1 := addTestObserver(t, ts.dt)
+	observer2 := addTestObserver(t, ts.dt)
+
+	failing := make(chan error, 1)
+	go func() {
+		// fails on the initializing messages
+		failing <- ts.dt.AddObserver(failingMaster{})
+	}()
+	if err := <-failing; err == nil {
+		t.Fatalf("Expected an error from AddObserver() for a failing observer")
+	}
+
+	// observer input is discarded
+	observer1.in.Write([]byte{Input, 'x'})
+
+	go ts.slaveOut.Write([]byte("foobar"))
+
+	for _, readFrame := range []func(*testing.T) []byte{ts.readFrame, observer1.readFrame, observer2.readFrame} {
+		if output := decodeOutput(t, readFrame(t)); !bytes.Equal(output, []byte("foobar")) {
+			t.Fatalf("Unexpected output received: `%s`", output)
+		}
+	}
+
+	if recorded := slave.recorded(); recorded != "" {
+		t.Fatalf("Observer input is written to the slave: `%s`", recorded)
+	}
+}
+
+func TestMaxObservers(t *testing.T) {
+	ts := newTestSession(t, WithMaxObservers(2))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	addTestObserver(t, ts.dt)
+	observer := addTestObserver(t, ts.dt)
+
+	if err := ts.dt.AddObserver(pipePair{}); err != ErrTooManyObservers {
+		t.Fatalf("Unexpected error from AddObserver(): %v", err)
+	}
+
+	// closing an observer frees its slot
+	observer.in.Close()
+	waitFor(t, func() bool {
+		ts.dt.observerMutex.Lock()
+		defer ts.dt.observerMutex.Unlock()
+		return len(ts.dt.observers) == 1
+	})
+	addTestObserver(t, ts.dt)
+}
+
+func TestRemoveObserver(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	removed := addTestObserver(t, ts.dt)
+	kept := addTestObserver(t, ts.dt)
+
+	infos := ts.dt.Observers()
+	if len(infos) != 2 || infos[0].ID == infos[1].ID || infos[0].AttachedAt.IsZero() {
+		t.Fatalf("Unexpected observers: %v", infos)
+	}
+
+	if err := ts.dt.RemoveObserver(infos[0].ID); err != nil {
+		t.Fatalf("Unexpected error from RemoveObserver(): %s", err)
+	}
+	if err := ts.dt.RemoveObserver(infos[0].ID); err != ErrObserverNotFound {
+		t.Fatalf("Unexpected error from RemoveObserver(): %v", err)
+	}
+	if remaining := ts.dt.Observers(); len(remaining) != 1 || remaining[0].ID != infos[1].ID {
+		t.Fatalf("Unexpected observers: %v", remaining)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _ := removed.out.Read(buf)
+		received <- buf[:n]
+	}()
+
+	go ts.slaveOut.Write([]byte("foobar"))
+	ts.readFrame(t)
+	if output := decodeOutput(t, kept.readFrame(t)); !bytes.Equal(output, []byte("foobar")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+
+	select {
+	case frame := <-received:
+		t.Fatalf("Removed observer received a message: `%s`", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestObserverDroppedOnWriteError(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	observer := addTestObserver(t, ts.dt)
+	observer.out.Close()
+
+	go ts.slaveOut.Write([]byte("foobar"))
+	ts.readFrame(t)
+
+	// the session goes on without the observer
+	ts.masterIn.Write([]byte{Ping})
+	if frame := ts.readFrame(t); !bytes.Equal(frame, []byte{Pong}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+
+	waitFor(t, func() bool { return len(ts.dt.Observers()) == 0 })
+}
+
+// blockingMaster blocks on writes after the window title
+// until released, without returning any error.
+type blockingMaster struct {
+	failingMaster
+	writes  *int32
+	release chan struct{}
+}
+
+func (bm blockingMaster) Write(p []byte) (int, error) {
+	if atomic.AddInt32(bm.writes, 1) > 1 {
+		<-bm.release
+	}
+	return len(p), nil
+}
+
+func TestSlowObserverDropped(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	release := make(chan struct{})
+	defer close(release)
+	err := ts.dt.AddObserver(blockingMaster{writes: new(int32), release: release})
+	if err != nil {
+		t.Fatalf("Unexpected error from AddObserver(): %s", err)
+	}
+	kept := addTestObserver(t, ts.dt)
+
+	// the master and the other observer keep getting output
+	const frames = observerQueueSize + 10
+	keptFrames := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n := 0
+		for ; n < frames; n++ {
+			if _, err := kept.out.Read(buf); err != nil {
+				break
+			}
+		}
+		keptFrames <- n
+	}()
+	for i := 0; i < frames; i++ {
+		go ts.slaveOut.Write([]byte("x"))
+		ts.readFrame(t)
+	}
+	select {
+	case n := <-keptFrames:
+		if n != frames {
+			t.Fatalf("Unexpected number of frames received by the other observer: %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The other observer did not receive all output")
+	}
+
+	waitFor(t, func() bool { return len(ts.dt.Observers()) == 1 })
+}
+
+func (ts *testSession) detached() bool {
+	ts.dt.writeMutex.Lock()
+	defer ts.dt.writeMutex.Unlock()
+	return ts.dt.detached
+}
+
+func (ts *testSession) scrollback() string {
+	ts.dt.writeMutex.Lock()
+	defer ts.dt.writeMutex.Unlock()
+	return string(ts.dt.scrollback.Bytes())
+}
+
+func TestReattach(t *testing.T) {
+	ts := newTestSession(t, WithReattach(0), WithScrollback(1024))
+	defer ts.close(t)
+
+	frame := ts.readInit(t)[1]
+	token, _ := json.Marshal(ts.dt.ReconnectToken())
+	if !bytes.Equal(frame, append([]byte{SetReconnectToken}, token...)) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+
+	ts.slaveOut.Write([]byte("foo"))
+	ts.readFrame(t)
+
+	// disconnect
+	ts.masterIn.Close()
+	waitFor(t, ts.detached)
+
+	// written only to the scrollback
+	ts.slaveOut.Write([]byte("bar"))
+	waitFor(t, func() bool { return ts.scrollback() == "foobar" })
+
+	connInPipeReader, connInPipeWriter := io.Pipe()
+	connOutPipeReader, connOutPipeWriter := io.Pipe()
+	reattached := &testSession{masterIn: connOutPipeWriter, masterOut: connInPipeReader}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ts.dt.Reattach(pipePair{connOutPipeReader, connInPipeWriter})
+	}()
+
+	reattached.readInit(t)
+	if output := decodeOutput(t, reattached.readFrame(t)); !bytes.Equal(output, []byte("foobar")) {
+		t.Fatalf("Unexpected scrollback replayed: `%s`", output)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error from Reattach(): %s", err)
+	}
+	// the close notice goes to the new master
+	ts.masterOut = reattached.masterOut
+
+	// the same slave goes on with the new master
+	go ts.slaveOut.Write([]byte("baz"))
+	if output := decodeOutput(t, reattached.readFrame(t)); !bytes.Equal(output, []byte("baz")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+	reattached.masterIn.Write([]byte{Ping})
+	if frame := reattached.readFrame(t); !bytes.Equal(frame, []byte{Pong}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+
+	select {
+	case err := <-ts.done:
+		t.Fatalf("Run() returned while reattached: %s", err)
+	default:
+	}
+}
+
+func TestReattachReplayEncoding(t *testing.T) {
+	ts := newTestSession(t, WithReattach(0), WithScrollback(1024))
+	defer ts.close(t)
+
+	// the first master gets binary output
+	ts.readInit(t)
+	ts.masterIn.Write(append([]byte{SetClientInfo}, `{"version":1,"capabilities":["binary_output"]}`...))
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+	go ts.slaveOut.Write([]byte("foo\x00bar"))
+	if frame := ts.readFrame(t); !bytes.Equal(frame, append([]byte{BinaryOutput}, "foo\x00bar"...)) {
+		t.Fatalf("Unexpected message received: %q", frame)
+	}
+
+	ts.masterIn.Close()
+	waitFor(t, ts.detached)
+
+	// the new master hasn't negotiated binary output
+	connInPipeReader, connInPipeWriter := io.Pipe()
+	connOutPipeReader, connOutPipeWriter := io.Pipe()
+	reattached := &testSession{masterIn: connOutPipeWriter, masterOut: connInPipeReader}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ts.dt.Reattach(pipePair{connOutPipeReader, connInPipeWriter})
+	}()
+	reattached.readInit(t)
+	frame := reattached.readFrame(t)
+	if frame[0] != Output {
+		t.Fatalf("Unexpected message received: %q", frame)
+	}
+	if output := decodeOutput(t, frame); !bytes.Equal(output, []byte("foo\x00bar")) {
+		t.Fatalf("Unexpected scrollback replayed: %q", output)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error from Reattach(): %s", err)
+	}
+	// the close notice goes to the new master
+	ts.masterOut = reattached.masterOut
+}
+
+func TestAttachCount(t *testing.T) {
+	ts := newTestSession(t, WithReattach(0))
+	defer ts.close(t)
+
+	ts.readInit(t)
+	for i := 1; i <= 2; i++ {
+		connInPipeReader, connInPipeWriter := io.Pipe()
+		connOutPipeReader, _ := io.Pipe()
+		reattached := &testSession{masterOut: connInPipeReader}
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- ts.dt.Reattach(pipePair{connOutPipeReader, connInPipeWriter})
+		}()
+		reattached.readInit(t)
+		if err := <-errs; err != nil {
+			t.Fatalf("Unexpected error from Reattach(): %s", err)
+		}
+		// the close notice goes to the new master
+		ts.masterOut = reattached.masterOut
+
+		if count := ts.dt.AttachCount(); count != i {
+			t.Fatalf("Unexpected attach count: %d", count)
+		}
+	}
+}
+
+func TestReattachTimeout(t *testing.T) {
+	ts := newTestSession(t, WithReattach(20*time.Millisecond))
+
+	ts.readInit(t)
+	ts.masterIn.Close()
+
+	select {
+	case err := <-ts.done:
+		if err != ErrMasterClosed {
+			t.Fatalf("Unexpected error from Run(): %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return after the reattach timeout")
+	}
+}
+
+func TestReattachTimeoutStoppedOnReturn(t *testing.T) {
+	ts := newTestSession(t, WithReattach(100*time.Millisecond))
+
+	ts.readInit(t)
+	ts.masterIn.Close()
+	waitFor(t, ts.detached)
+	ts.cancel()
+	if err := ts.runError(t); err != context.Canceled {
+		t.Fatalf("Unexpected error from Run(): %s", err)
+	}
+
+	// the timeout of the last run doesn't end the next run
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ts.dt.Run(ctx)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Run() returned by the reattach timeout of the last run: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	cancel()
+	<-done
+}
+
+func TestReattachNotEnabled(t *testing.T) {
+	dt, err := New(pipePair{}, slavePipe{})
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+	if err := dt.Reattach(pipePair{}); err == nil {
+		t.Fatalf("Expected an error from Reattach()")
+	}
+}
+
+func (ts *testSession) pausedOutput() string {
+	ts.dt.pauseMutex.Lock()
+	defer ts.dt.pauseMutex.Unlock()
+	if ts.dt.pauseBuffer == nil {
+		return ""
+	}
+	return string(ts.dt.pauseBuffer.Bytes())
+}
+
+func TestPauseResume(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	ts.dt.Pause()
+	for _, chunk := range []string{"foo", "bar", "baz"} {
+		ts.slaveOut.Write([]byte(chunk))
+	}
+	waitFor(t, func() bool { return ts.pausedOutput() == "foobarbaz" })
+
+	// nothing but Pong is sent while paused
+	ts.masterIn.Write([]byte{Ping})
+	if frame := ts.readFrame(t); !bytes.Equal(frame, []byte{Pong}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ts.dt.Resume()
+	}()
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("foobarbaz")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error from Resume(): %s", err)
+	}
+
+	go ts.slaveOut.Write([]byte("qux"))
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("qux")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	ts := newTestSession(t, WithBanner("\x1b[1mwelcome\x1b[0m\n"))
+	defer ts.close(t)
+
+	go ts.slaveOut.Write([]byte("prompt$ "))
+
+	ts.readInit(t)
+
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("\x1b[1mwelcome\x1b[0m\r\n")) {
+		t.Fatalf("Unexpected banner received: %q", output)
+	}
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("prompt$ ")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+}
+
+func TestRespawn(t *testing.T) {
+	respawned := make(chan *io.PipeWriter, 2)
+	factory := func() (Slave, error) {
+		slaveOutPipeReader, slaveOutPipeWriter := io.Pipe()
+		_, slaveInPipeWriter := io.Pipe()
+		respawned <- slaveOutPipeWriter
+		return slavePipe{pipePair{slaveOutPipeReader, slaveInPipeWriter}}, nil
+	}
+
+	ts := newTestSession(t, WithRespawn(factory, 2), WithRespawnDelay(time.Millisecond))
+	defer ts.cancel()
+
+	slaveOut := ts.slaveOut
+	for i, chunk := range []string{"first", "second", "third"} {
+		ts.readInit(t) // sent again after respawn
+
+		go slaveOut.Write([]byte(chunk))
+		if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte(chunk)) {
+			t.Fatalf("Unexpected output received from slave %d: `%s`", i, output)
+		}
+		slaveOut.Close()
+
+		if i < 2 {
+			slaveOut = <-respawned
+		}
+	}
+
+	if err := <-ts.done; err != ErrSlaveClosed {
+		t.Fatalf("Unexpected error from Run(): %v", err)
+	}
+	if len(respawned) != 0 {
+		t.Fatalf("Unexpected respawn over the limit")
+	}
+}
+
+func TestInputNewline(t *testing.T) {
+	testCases := []struct {
+		mode     NewlineMode
+		inputs   []string
+		expected string
+	}{
+		{NewlineCR, []string{"ls\r\n"}, "ls\r"},
+		{NewlineCR, []string{"ls\n", "pwd\n"}, "ls\rpwd\r"},
+		{NewlineCR, []string{"ls\r", "\npwd\r"}, "ls\rpwd\r"},
+		{NewlineLF, []string{"ls\r\n", "pwd\r"}, "ls\npwd\n"},
+		{NewlinePassthrough, []string{"ls\r\n", "pwd\n"}, "ls\r\npwd\n"},
+	}
+
+	for _, tc := range testCases {
+		var slave recordingSlave
+		ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+			slave = newRecordingSlave(sp)
+			return slave
+		}, WithPermitWrite(), WithInputNewline(tc.mode))
+
+		ts.readInit(t)
+		for _, input := range tc.inputs {
+			ts.masterIn.Write(append([]byte{Input}, input...))
+		}
+		waitFor(t, func() bool { return len(slave.recorded()) >= len(tc.expected) })
+		if recorded := slave.recorded(); recorded != tc.expected {
+			t.Fatalf("Unexpected input written with mode %d: %q", tc.mode, recorded)
+		}
+
+		ts.close(t)
+	}
+}
+
+func TestByteQuota(t *testing.T) {
+	ts := newTestSession(t, WithByteQuota(1024))
+	defer ts.cancel()
+
+	ts.readInit(t)
+
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 256)
+		for i := 0; i < 64; i++ {
+			_, err := ts.slaveOut.Write(chunk)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var received int
+	for {
+		frame := ts.readFrame(t)
+		if frame[0] == ServerClose {
+			var reason string
+			if err := json.Unmarshal(frame[1:], &reason); err != nil {
+				t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+			}
+			if reason != ErrQuotaExceeded.Error() {
+				t.Fatalf("Unexpected close reason: `%s`", reason)
+			}
+			break
+		}
+		received += len(frame)
+		if received > 2*1024 {
+			t.Fatalf("Session not closed after the quota is exceeded, %d bytes received", received)
+		}
+	}
+
+	select {
+	case err := <-ts.done:
+		if err != ErrQuotaExceeded {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return")
+	}
+	ts.slaveOut.Close()
+}
+
+func TestOnBell(t *testing.T) {
+	var bells int64
+	ts := newTestSession(t, WithOnBell(func() { atomic.AddInt64(&bells, 1) }))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	// BEL terminating the OSC sequence isn't a bell
+	go ts.slaveOut.Write([]byte("\aone\a\x1b]0;title\a\atwo"))
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("\aone\a\x1b]0;title\a\atwo")) {
+		t.Fatalf("Unexpected output received: %q", output)
+	}
+	if n := atomic.LoadInt64(&bells); n != 3 {
+		t.Fatalf("Unexpected number of bells: %d", n)
+	}
+}
+
+func TestInputBase64(t *testing.T) {
+	var slave recordingSlave
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		slave = newRecordingSlave(sp)
+		return slave
+	}, WithPermitWrite())
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	// malformed input is ignored without closing the session
+	ts.masterIn.Write([]byte{InputBase64, '!', '!'})
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("\x1b[A\x00\x03"))
+	ts.masterIn.Write(append([]byte{InputBase64}, encoded...))
+
+	waitFor(t, func() bool { return slave.recorded() != "" })
+	if recorded := slave.recorded(); recorded != "\x1b[A\x00\x03" {
+		t.Fatalf("Unexpected input written: %q", recorded)
+	}
+}
+
+func TestRequestRedraw(t *testing.T) {
+	ts := newTestSession(t, WithScrollback(1024))
+	defer ts.close(t)
+
+	ts.readInit(t)
+	go ts.slaveOut.Write([]byte("foo"))
+	ts.readFrame(t)
+
+	ts.masterIn.Write([]byte{RequestRedraw})
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("\x1bcfoo")) {
+		t.Fatalf("Unexpected redraw received: %q", output)
+	}
+
+	// the redraw itself is not kept in the scrollback
+	if scrollback := ts.scrollback(); scrollback != "foo" {
+		t.Fatalf("Unexpected scrollback: %q", scrollback)
+	}
+}
+
+func TestRequestRedrawWithoutScrollback(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+	ts.masterIn.Write([]byte{RequestRedraw})
+	ts.masterIn.Write([]byte{Ping})
+	if frame := ts.readFrame(t); !bytes.Equal(frame, []byte{Pong}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+}
+
+func TestClipboardPassthrough(t *testing.T) {
+	ts := newTestSession(t, WithClipboardPassthrough())
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	// split across reads and terminated by ST
+	sequence := "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte("copied")) + "\x1b\\"
+	go func() {
+		ts.slaveOut.Write([]byte("foo" + sequence[:8]))
+		ts.slaveOut.Write([]byte(sequence[8:]))
+	}()
+
+	ts.readFrame(t) // output in the first read
+	frame := ts.readFrame(t)
+	if !bytes.Equal(frame, append([]byte{Clipboard}, `"copied"`...)) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte(sequence[8:])) {
+		t.Fatalf("Unexpected output received: %q", output)
+	}
+
+	// reading the clipboard and malformed data are ignored
+	go ts.slaveOut.Write([]byte("\x1b]52;c;?\a\x1b]52;c;!!\a"))
+	ts.readFrame(t)
+	ts.masterIn.Write([]byte{Ping})
+	if frame := ts.readFrame(t); !bytes.Equal(frame, []byte{Pong}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+}
+
+func TestClipboardDisabled(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+	go ts.slaveOut.Write([]byte("\x1b]52;c;Zm9v\a"))
+	if frame := ts.readFrame(t); frame[0] != Output {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+}
+
+// failingWriter fails writes after accepting n bytes.
+type failingWriter struct {
+	mutex   sync.Mutex
+	written bytes.Buffer
+	n       int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.written.Len()+len(p) > fw.n {
+		return 0, errors.New("tee failed")
+	}
+	return fw.written.Write(p)
+}
+
+func (fw *failingWriter) String() string {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	return fw.written.String()
+}
+
+func TestOutputTee(t *testing.T) {
+	tee := &failingWriter{n: 7}
+	ts := newTestSession(t, WithOutputTee(tee))
+	defer ts.close(t)
+
+	ts.readInit(t)
+	for _, chunk := range []string{"foo", "bar\x00", "baz"} {
+		go ts.slaveOut.Write([]byte(chunk))
+		if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte(chunk)) {
+			t.Fatalf("Unexpected output received: %q", output)
+		}
+	}
+
+	// the last chunk is over the limit of the tee
+	if written := tee.String(); written != "foobar\x00" {
+		t.Fatalf("Unexpected output written to tee: %q", written)
+	}
+}
+
+func TestTransformPipeline(t *testing.T) {
+	replace := func(old, new string) Transform {
+		return func(data []byte) []byte {
+			return bytes.Replace(data, []byte(old), []byte(new), -1)
+		}
+	}
+	var slave recordingSlave
+	ts := newTestSessionWithSlave(t, func(sp slavePipe) Slave {
+		slave = newRecordingSlave(sp)
+		return slave
+	},
+		WithPermitWrite(),
+		// the second one gets the output of the first one
+		WithTransformPipeline(DirectionToMaster, replace("foo", "bar"), replace("bar", "baz")),
+		WithTransformPipeline(DirectionToSlave, replace("secret", "******")),
+	)
+	defer ts.close(t)
+
+	ts.readInit(t)
+	go ts.slaveOut.Write([]byte("foo bar"))
+	if output := decodeOutput(t, ts.readFrame(t)); !bytes.Equal(output, []byte("baz baz")) {
+		t.Fatalf("Unexpected output received: %q", output)
+	}
+
+	ts.masterIn.Write(append([]byte{Input}, "echo secret\n"...))
+	waitFor(t, func() bool { return len(slave.recorded()) >= len("echo ******\n") })
+	if recorded := slave.recorded(); recorded != "echo ******\n" {
+		t.Fatalf("Unexpected input written: %q", recorded)
+	}
+
+	// injected input can't bypass input transforms
+	err := ts.dt.InjectInput([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error from InjectInput(): %s", err)
+	}
+	waitFor(t, func() bool { return len(slave.recorded()) >= len("echo ******\n******") })
+	if recorded := slave.recorded(); recorded != "echo ******\n******" {
+		t.Fatalf("Unexpected input written: %q", recorded)
+	}
+
+	_, err = New(pipePair{}, slavePipe{}, WithTransformPipeline(DirectionFromMaster))
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown direction")
+	}
+}
+
+func TestPingPayload(t *testing.T) {
+	ts := newTestSession(t)
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	timestamp := []byte{0, 0, 1, 0x5f, 0x2a, 0x10, 0x20, 0x30}
+	ts.masterIn.Write(append([]byte{Ping}, timestamp...))
+	if frame := ts.readFrame(t); !bytes.Equal(frame, append([]byte{Pong}, timestamp...)) {
+		t.Fatalf("Unexpected message received: %q", frame)
+	}
+
+	ts.masterIn.Write([]byte{Ping})
+	if frame := ts.readFrame(t); !bytes.Equal(frame, []byte{Pong}) {
+		t.Fatalf("Unexpected message received: %q", frame)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ts := newTestSessionWith(t, func(pp pipePair) Master {
+		return slowMaster{pp, new(int32), release}
+	}, nil, WithWriteTimeout(50*time.Millisecond))
+	defer ts.cancel()
+
+	ts.readInit(t)
+	go ts.slaveOut.Write([]byte("foo"))
+
+	select {
+	case err := <-ts.done:
+		if errors.Cause(err) != ErrMasterClosed {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return")
+	}
+}
+
+func TestCancelWithBlockedMaster(t *testing.T) {
+	ts := newTestSession(t)
+	// releases the blocked writes
+	defer ts.masterOut.Close()
+
+	ts.readInit(t)
+	// nobody reads the output, so the write blocks holding the write lock
+	go ts.slaveOut.Write([]byte("foo"))
+	time.Sleep(50 * time.Millisecond)
+
+	ts.cancel()
+	select {
+	case err := <-ts.done:
+		if err != context.Canceled {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(closeNoticeTimeout + time.Second):
+		t.Fatalf("Run() did not return after cancel")
+	}
+}
+
+func TestWriteTimeoutDeadWriter(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	writes := new(int32)
+	ts := newTestSessionWith(t, func(pp pipePair) Master {
+		return slowMaster{pp, writes, release}
+	}, nil, WithWriteTimeout(50*time.Millisecond))
+	defer ts.cancel()
+
+	ts.readInit(t)
+	go ts.slaveOut.Write([]byte("foo"))
+	ts.runError(t)
+
+	// the timed out write is still going on
+	if err := ts.dt.Notify("hi"); errors.Cause(err) != ErrMasterClosed {
+		t.Fatalf("Unexpected error from Notify(): %v", err)
+	}
+	if n := atomic.LoadInt32(writes); n != 3 {
+		t.Fatalf("Unexpected number of writes to the master: %d", n)
+	}
+}
+
+func TestSlaveWriteTimeout(t *testing.T) {
+	ts := newTestSession(t, WithPermitWrite(), WithSlaveWriteTimeout(50*time.Millisecond))
+	defer ts.cancel()
+
+	ts.readInit(t)
+	// nobody reads the input of the slave
+	ts.masterIn.Write([]byte{Input, 'l', 's'})
+
+	if frame := ts.readFrame(t); frame[0] != ServerClose {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	select {
+	case err := <-ts.done:
+		if errors.Cause(err) != ErrSlaveClosed {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return")
+	}
+}
+
+func TestWriteTimeoutWithDeadline(t *testing.T) {
+	masterConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	slaveOutPipeReader, slaveOutPipeWriter := io.Pipe()
+	_, slaveInPipeWriter := io.Pipe()
+
+	dt, err := New(masterConn, slavePipe{pipePair{slaveOutPipeReader, slaveInPipeWriter}}, WithWriteTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dt.Run(context.Background())
+	}()
+
+	// nobody reads clientConn
+	select {
+	case err := <-done:
+		if errors.Cause(err) != ErrMasterClosed {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return")
+	}
+	slaveOutPipeWriter.Close()
+}
+
+func TestOutputRateLimit(t *testing.T) {
+	ts := newTestSession(t, WithOutputRateLimit(2000))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	chunk := bytes.Repeat([]byte("x"), 100)
+	go func() {
+		for i := 0; i < 5; i++ {
+			ts.slaveOut.Write(chunk)
+		}
+	}()
+
+	start := time.Now()
+	var received []byte
+	for len(received) < 5*len(chunk) {
+		received = append(received, decodeOutput(t, ts.readFrame(t))...)
+	}
+
+	// 400 bytes are paced before sending the last chunk
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("Output not throttled, sent in %s", elapsed)
+	}
+	if !bytes.Equal(received, bytes.Repeat(chunk, 5)) {
+		t.Fatalf("Unexpected output received: `%s`", received)
+	}
+}
+
+// withBufferSize sets the size of the buffer to read the slave and the master.
+func withBufferSize(size int) Option {
+	return func(wt *WebTTY) error {
+		wt.bufferSize = size
+		return nil
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	ts := newTestSession(t, WithMaxFrameSize(64*1024), withBufferSize(1024*1024))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go ts.slaveOut.Write(data)
+
+	var received []byte
+	frames := 0
+	for len(received) < len(data) {
+		frame := ts.readFrame(t)
+		if len(frame) > 64*1024 {
+			t.Fatalf("Unexpected frame size: %d", len(frame))
+		}
+		received = append(received, decodeOutput(t, frame)...)
+		frames++
+	}
+	if frames < 16 {
+		t.Fatalf("Unexpected number of frames: %d", frames)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("Unexpected output received")
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	ts := newTestSession(t, WithReconnect(10), WithReconnectBackoff(500*time.Millisecond, time.Minute, 2))
+	defer ts.close(t)
+
+	frames := ts.readInit(t)
+	if !bytes.Equal(frames[1], []byte{SetReconnect, '1', '0'}) {
+		t.Fatalf("Unexpected message received: `%s`", frames[1])
+	}
+	if !bytes.Equal(frames[2], append([]byte{SetReconnectPolicy}, `{"base":0.5,"max":60,"multiplier":2}`...)) {
+		t.Fatalf("Unexpected message received: `%s`", frames[2])
+	}
+
+	for _, tc := range []struct {
+		base, max  time.Duration
+		multiplier float64
+	}{
+		{base: -time.Second, max: time.Minute, multiplier: 2},
+		{base: time.Second, max: -time.Minute, multiplier: 2},
+		{base: time.Minute, max: time.Second, multiplier: 2},
+		{base: time.Second, max: time.Minute, multiplier: 0.5},
+	} {
+		_, err := New(pipePair{}, slavePipe{}, WithReconnectBackoff(tc.base, tc.max, tc.multiplier))
+		if err == nil {
+			t.Fatalf("Expected an error from New() for %+v", tc)
+		}
+	}
+}
+
+func TestResizeTerminal(t *testing.T) {
+	slave := webttytest.NewMockSlave()
+	ts := newTestSessionWithSlave(t, func(slavePipe) Slave { return slave }, WithFixedRows(30))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	err := ts.dt.ResizeTerminal(100, 50)
+	if err != nil {
+		t.Fatalf("Unexpected error from ResizeTerminal(): %s", err)
+	}
+	if columns, rows := ts.dt.TerminalSize(); columns != 100 || rows != 30 {
+		t.Fatalf("Unexpected terminal size: %dx%d", columns, rows)
+	}
+
+	ts.dt.ResizeTerminal(70000, -1)
+
+	// the same path as resizing requested by the master
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":80,"rows":24}`...))
+	waitFor(t, func() bool { return len(slave.Resizes()) == 3 })
+
+	expected := []webttytest.Size{{Columns: 100, Rows: 30}, {Columns: 65535, Rows: 30}, {Columns: 80, Rows: 30}}
+	for i, size := range slave.Resizes() {
+		if size != expected[i] {
+			t.Fatalf("Unexpected size %d: %v", i, size)
+		}
+	}
+	if columns, rows := ts.dt.TerminalSize(); columns != 80 || rows != 30 {
+		t.Fatalf("Unexpected terminal size: %dx%d", columns, rows)
+	}
+}
+
+func TestResizeAck(t *testing.T) {
+	ts := newTestSession(t, WithFixedRows(30))
+	defer ts.close(t)
+
+	ts.readInit(t)
+
+	// legacy masters get no ack
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":80,"rows":24}`...))
+	ts.masterIn.Write([]byte{Ping})
+	if frame := ts.readFrame(t); frame[0] != Pong {
+		t.Fatalf("Unexpected message received: %q", frame)
+	}
+
+	ts.masterIn.Write(append([]byte{SetClientInfo}, `{"version":1,"capabilities":["resize_ack"]}`...))
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":100,"rows":50}`...))
+	frame := ts.readFrame(t)
+	if frame[0] != ResizeAck {
+		t.Fatalf("Unexpected message received: %q", frame)
+	}
+	var size WindowSize
+	err := json.Unmarshal(frame[1:], &size)
+	if err != nil {
+		t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+	}
+	// the clamped size, not the requested one
+	if size != (WindowSize{Columns: 100, Rows: 30}) {
+		t.Fatalf("Unexpected size acknowledged: %+v", size)
+	}
+}
+
+func TestInitialResizeDelay(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	slave := webttytest.NewMockSlave()
+	ts := newTestSessionWithSlave(t, func(slavePipe) Slave { return slave }, WithInitialResizeDelay(delay))
+	defer ts.close(t)
+
+	ts.readInit(t)
+	start := time.Now()
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":80,"rows":24}`...))
+	waitFor(t, func() bool { return len(slave.Resizes()) == 1 })
+	// the delay started before the initializing messages were read
+	if elapsed := time.Since(start); elapsed < delay/2 {
+		t.Fatalf("The first resizing was applied after %s", elapsed)
+	}
+
+	start = time.Now()
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":100,"rows":50}`...))
+	waitFor(t, func() bool { return len(slave.Resizes()) == 2 })
+	if elapsed := time.Since(start); elapsed >= delay/2 {
+		t.Fatalf("The second resizing was applied after %s", elapsed)
+	}
+}
+
+func TestInitialResizeDelayFirstOutput(t *testing.T) {
+	slave := webttytest.NewMockSlave()
+	ts := newTestSessionWithSlave(t, func(slavePipe) Slave { return slave }, WithInitialResizeDelay(time.Minute))
+	defer ts.close(t)
+
+	ts.readInit(t)
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":80,"rows":24}`...))
+
+	// only the resizing is held, the master is still read
+	ts.masterIn.Write([]byte{Ping})
+	if frame := ts.readFrame(t); !bytes.Equal(frame, []byte{Pong}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	if resizes := slave.Resizes(); len(resizes) != 0 {
+		t.Fatalf("Unexpected resizing before the first output: %v", resizes)
+	}
+
+	// the first prompt releases the resizing
+	go slave.Output([]byte("$ "))
+	ts.readFrame(t)
+	waitFor(t, func() bool { return len(slave.Resizes()) == 1 })
+}
+
+func TestInitialResizeDelayStoppedOnReturn(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	slave := webttytest.NewMockSlave()
+	ts := newTestSessionWithSlave(t, func(slavePipe) Slave { return slave }, WithInitialResizeDelay(delay))
+
+	ts.readInit(t)
+	ts.masterIn.Write(append([]byte{ResizeTerminal}, `{"columns":80,"rows":24}`...))
+	ts.masterIn.Write([]byte{Ping})
+	ts.readFrame(t)
+
+	ts.cancel()
+	if frame := ts.readFrame(t); frame[0] != ServerClose {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	if err := <-ts.done; err != context.Canceled {
+		t.Fatalf("Unexpected error from Run(): %v", err)
+	}
+
+	time.Sleep(2 * delay)
+	if resizes := slave.Resizes(); len(resizes) != 0 {
+		t.Fatalf("Unexpected resizing after Run() returned: %v", resizes)
+	}
+}
+
+func TestOnClose(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		close    func(ts *testSession)
+		expected error
+	}{
+		{name: "cancel", close: func(ts *testSession) {
+			ts.cancel()
+			go ts.masterOut.Read(make([]byte, 1024))
+		}, expected: nil},
+		{name: "slave", close: func(ts *testSession) { ts.slaveOut.Close() }, expected: ErrSlaveClosed},
+		{name: "master", close: func(ts *testSession) { ts.masterIn.Close() }, expected: ErrMasterClosed},
+		{name: "both", close: func(ts *testSession) {
+			go ts.slaveOut.Close()
+			go ts.masterIn.Close()
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var errs []error
+			ts := newTestSession(t, WithOnClose(func(err error) {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}))
+			defer ts.cancel()
+
+			ts.readInit(t)
+			tc.close(ts)
+
+			var runErr error
+			select {
+			case runErr = <-ts.done:
+			case <-time.After(time.Second):
+				t.Fatalf("Run() did not return")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(errs) != 1 {
+				t.Fatalf("Unexpected number of calls: %d", len(errs))
+			}
+			if tc.name == "both" {
+				if errs[0] != runErr {
+					t.Fatalf("Unexpected error: %v, Run() returned %v", errs[0], runErr)
+				}
+				return
+			}
+			if errs[0] != tc.expected {
+				t.Fatalf("Unexpected error: %v", errs[0])
+			}
+		})
+	}
+}
+
+func TestCloseNoticeCause(t *testing.T) {
+	ts := newTestSession(t)
+	ts.readInit(t)
+	ts.close(t)
+
+	for _, tc := range []struct {
+		cause    error
+		expected string
+	}{
+		{cause: errors.New("server is shutting down"), expected: "server is shutting down"},
+		{cause: nil, expected: "context canceled"},
+	} {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- ts.dt.Run(ctx)
+		}()
+
+		ts.readInit(t)
+		cancel(tc.cause)
+
+		frame := ts.readFrame(t)
+		if frame[0] != ServerClose {
+			t.Fatalf("Unexpected message received: `%s`", frame)
+		}
+		var reason string
+		err := json.Unmarshal(frame[1:], &reason)
+		if err != nil {
+			t.Fatalf("Unexpected error from Unmarshal(): %s", err)
+		}
+		if reason != tc.expected {
+			t.Fatalf("Unexpected close reason: %s", reason)
+		}
+		if err := <-done; err != context.Canceled {
+			t.Fatalf("Unexpected error from Run(): %s", err)
+		}
+	}
+}
+
+func TestReconnectValidation(t *testing.T) {
+	for _, tc := range []struct {
+		seconds int
+		valid   bool
+	}{
+		{seconds: -1, valid: false},
+		{seconds: 0, valid: true},
+		{seconds: MaxReconnect, valid: true},
+		{seconds: MaxReconnect + 1, valid: false},
+	} {
+		dt, err := New(pipePair{}, slavePipe{}, WithReconnect(tc.seconds))
+		if tc.valid {
+			if err != nil {
+				t.Fatalf("Unexpected error from New() for %d seconds: %s", tc.seconds, err)
+			}
+			if dt.reconnect != tc.seconds {
+				t.Fatalf("Unexpected reconnect time: %d", dt.reconnect)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("Expected an error from New() for %d seconds", tc.seconds)
+		}
+	}
 }
@@ -0,0 +1,84 @@
+// Package webttytest provides mock masters and slaves for testing code
+// using package webtty.
+//
+// A typical test runs a WebTTY between the mocks,
+// and plays the client and the command with them:
+//
+//	master := webttytest.NewMockMaster()
+//	slave := webttytest.NewMockSlave()
+//	wt, _ := webtty.New(master, slave, webtty.WithPermitWrite())
+//	go wt.Run(ctx)
+//
+//	master.Receive()                          // window title
+//	master.Receive()                          // protocol info
+//	master.Send(webtty.Input, []byte("ls\r"))
+//	slave.ReadInput()                         // "ls\r"
+//	slave.Output([]byte("foo\r\n"))
+//	master.Receive()                          // "foo\r\n" as base64 Output
+//
+// The pipes aren't buffered, the WebTTY is blocked
+// until each message and input written by it is read.
+package webttytest
+
+import (
+	"io"
+)
+
+// MockMaster is a master backed by pipes.
+// Messages sent by Send are read by the WebTTY,
+// and messages written by the WebTTY are returned by Receive.
+type MockMaster struct {
+	inReader  *io.PipeReader
+	inWriter  *io.PipeWriter
+	outReader *io.PipeReader
+	outWriter *io.PipeWriter
+}
+
+// NewMockMaster creates a new MockMaster.
+func NewMockMaster() *MockMaster {
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	return &MockMaster{
+		inReader:  inReader,
+		inWriter:  inWriter,
+		outReader: outReader,
+		outWriter: outWriter,
+	}
+}
+
+// Read reads a message sent by Send, called by the WebTTY.
+func (m *MockMaster) Read(p []byte) (int, error) {
+	return m.inReader.Read(p)
+}
+
+// Write writes a message to be returned by Receive, called by the WebTTY.
+// It blocks until the message is received.
+func (m *MockMaster) Write(p []byte) (int, error) {
+	return m.outWriter.Write(p)
+}
+
+// Send sends a message of the type to the WebTTY.
+// It blocks until the WebTTY reads the message.
+func (m *MockMaster) Send(messageType byte, payload []byte) error {
+	_, err := m.inWriter.Write(append([]byte{messageType}, payload...))
+	return err
+}
+
+// Receive returns the next message written by the WebTTY,
+// including the message type byte.
+func (m *MockMaster) Receive() ([]byte, error) {
+	buf := make([]byte, 1024*1024)
+	n, err := m.outReader.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Close closes the master, the WebTTY gets an error
+// when it reads or writes the master.
+func (m *MockMaster) Close() error {
+	m.inWriter.Close()
+	m.outReader.Close()
+	return nil
+}
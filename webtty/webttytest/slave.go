@@ -0,0 +1,104 @@
+package webttytest
+
+import (
+	"io"
+	"sync"
+)
+
+// Size is a terminal size given to ResizeTerminal.
+type Size struct {
+	Columns int
+	Rows    int
+}
+
+// MockSlave is a slave backed by pipes.
+// Output written by Output is read by the WebTTY,
+// and input written by the WebTTY is returned by ReadInput.
+type MockSlave struct {
+	// TitleVariables is returned by WindowTitleVariables.
+	TitleVariables map[string]interface{}
+	// OnResize is called by ResizeTerminal when it's not nil,
+	// and its error is returned.
+	OnResize func(columns int, rows int) error
+
+	outReader *io.PipeReader
+	outWriter *io.PipeWriter
+	inReader  *io.PipeReader
+	inWriter  *io.PipeWriter
+
+	mutex   sync.Mutex
+	resizes []Size
+}
+
+// NewMockSlave creates a new MockSlave.
+func NewMockSlave() *MockSlave {
+	outReader, outWriter := io.Pipe()
+	inReader, inWriter := io.Pipe()
+	return &MockSlave{
+		TitleVariables: map[string]interface{}{},
+		outReader:      outReader,
+		outWriter:      outWriter,
+		inReader:       inReader,
+		inWriter:       inWriter,
+	}
+}
+
+// Read reads output written by Output, called by the WebTTY.
+func (s *MockSlave) Read(p []byte) (int, error) {
+	return s.outReader.Read(p)
+}
+
+// Write writes input to be returned by ReadInput, called by the WebTTY.
+// It blocks until the input is read.
+func (s *MockSlave) Write(p []byte) (int, error) {
+	return s.inWriter.Write(p)
+}
+
+// WindowTitleVariables returns TitleVariables.
+func (s *MockSlave) WindowTitleVariables() map[string]interface{} {
+	return s.TitleVariables
+}
+
+// ResizeTerminal records the size and calls OnResize.
+func (s *MockSlave) ResizeTerminal(columns int, rows int) error {
+	s.mutex.Lock()
+	s.resizes = append(s.resizes, Size{Columns: columns, Rows: rows})
+	s.mutex.Unlock()
+
+	if s.OnResize != nil {
+		return s.OnResize(columns, rows)
+	}
+	return nil
+}
+
+// Resizes returns the sizes given to ResizeTerminal in order.
+func (s *MockSlave) Resizes() []Size {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Size(nil), s.resizes...)
+}
+
+// Output emits data as output of the slave.
+// It blocks until the WebTTY reads the data.
+func (s *MockSlave) Output(data []byte) error {
+	_, err := s.outWriter.Write(data)
+	return err
+}
+
+// ReadInput returns the next input written by the WebTTY.
+func (s *MockSlave) ReadInput() ([]byte, error) {
+	buf := make([]byte, 1024*1024)
+	n, err := s.inReader.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Close closes the output of the slave as if the command exited,
+// the WebTTY returns ErrSlaveClosed.
+func (s *MockSlave) Close() error {
+	s.outWriter.Close()
+	s.inReader.Close()
+	return nil
+}
@@ -0,0 +1,99 @@
+package webttytest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/yudai/gotty/webtty"
+	"github.com/yudai/gotty/webtty/webttytest"
+)
+
+var (
+	_ webtty.Master = &webttytest.MockMaster{}
+	_ webtty.Slave  = &webttytest.MockSlave{}
+)
+
+func TestHandshakeAndEcho(t *testing.T) {
+	master := webttytest.NewMockMaster()
+	slave := webttytest.NewMockSlave()
+
+	wt, err := webtty.New(master, slave, webtty.WithPermitWrite(), webtty.WithWindowTitle([]byte("mock")))
+	if err != nil {
+		t.Fatalf("Unexpected error from New(): %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- wt.Run(ctx)
+	}()
+
+	// handshake
+	frame, err := master.Receive()
+	if err != nil {
+		t.Fatalf("Unexpected error from Receive(): %s", err)
+	}
+	if !bytes.Equal(frame, []byte{webtty.SetWindowTitle, 'm', 'o', 'c', 'k'}) {
+		t.Fatalf("Unexpected message received: `%s`", frame)
+	}
+	frame, err = master.Receive()
+	if err != nil {
+		t.Fatalf("Unexpected error from Receive(): %s", err)
+	}
+	if frame[0] != webtty.SetProtocolInfo {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+
+	err = master.Send(webtty.ResizeTerminal, []byte(`{"columns":80,"rows":24}`))
+	if err != nil {
+		t.Fatalf("Unexpected error from Send(): %s", err)
+	}
+
+	// echo
+	err = master.Send(webtty.Input, []byte("hello"))
+	if err != nil {
+		t.Fatalf("Unexpected error from Send(): %s", err)
+	}
+	input, err := slave.ReadInput()
+	if err != nil {
+		t.Fatalf("Unexpected error from ReadInput(): %s", err)
+	}
+	if !bytes.Equal(input, []byte("hello")) {
+		t.Fatalf("Unexpected input written: `%s`", input)
+	}
+
+	go slave.Output(input)
+	frame, err = master.Receive()
+	if err != nil {
+		t.Fatalf("Unexpected error from Receive(): %s", err)
+	}
+	if frame[0] != webtty.Output {
+		t.Fatalf("Unexpected message type `%c`", frame[0])
+	}
+	output, err := base64.StdEncoding.DecodeString(string(frame[1:]))
+	if err != nil {
+		t.Fatalf("Unexpected error from DecodeString(): %s", err)
+	}
+	if !bytes.Equal(output, []byte("hello")) {
+		t.Fatalf("Unexpected output received: `%s`", output)
+	}
+
+	resizes := slave.Resizes()
+	if len(resizes) != 1 || resizes[0] != (webttytest.Size{Columns: 80, Rows: 24}) {
+		t.Fatalf("Unexpected resizes: %v", resizes)
+	}
+
+	slave.Close()
+	select {
+	case err := <-done:
+		if err != webtty.ErrSlaveClosed {
+			t.Fatalf("Unexpected error from Run(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() did not return")
+	}
+}
@@ -0,0 +1,74 @@
+package webtty
+
+import (
+	"context"
+	"errors"
+)
+
+// errSlaveReadFailed tells that reading the slave has failed,
+// the error to return is decided after the queue is flushed.
+var errSlaveReadFailed = errors.New("failed to read slave")
+
+// readSlaveQueued works like readSlave, but hands output to a goroutine
+// writing to the master through a bounded queue.
+// Reading the slave blocks while the queue is full.
+func (wt *WebTTY) readSlaveQueued(ctx context.Context) error {
+	queue := make(chan *[]byte, wt.writeQueueDepth)
+	writerDone := make(chan struct{})
+	var writerErr error
+
+	go func() {
+		defer close(writerDone)
+		for chunk := range queue {
+			err := wt.handleSlaveReadEvent(*chunk)
+			putFrame(chunk)
+			if err != nil {
+				writerErr = err
+				return
+			}
+		}
+	}()
+
+	err := wt.pumpSlave(ctx, queue, writerDone)
+	close(queue)
+	<-writerDone
+	if writerErr != nil {
+		return writerErr
+	}
+	if err == errSlaveReadFailed {
+		// notify the exit status after all queued and coalesced output
+		wt.flushPendingOutput()
+		return wt.slaveReadError(ctx)
+	}
+	return err
+}
+
+// pumpSlave reads the slave and queues the output until an error occurs.
+// A failure of the writer is noticed on the next read.
+func (wt *WebTTY) pumpSlave(ctx context.Context, queue chan<- *[]byte, writerDone <-chan struct{}) error {
+	buffer := make([]byte, wt.bufferSize)
+	for {
+		n, err := wt.slaveRead(ctx, buffer)
+		if err != nil {
+			return errSlaveReadFailed
+		}
+
+		err = wt.throttleOutput(ctx, n)
+		if err != nil {
+			return err
+		}
+
+		chunk := getFrame(n)
+		copy(*chunk, buffer[:n])
+
+		select {
+		case queue <- chunk:
+		case <-writerDone:
+			putFrame(chunk)
+			return nil
+		case <-ctx.Done():
+			putFrame(chunk)
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package webtty
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// deadlineWriter is implemented by masters such as net.Conn
+// and slaves such as os.File that can give up blocked writes by themselves.
+type deadlineWriter interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// writeToMaster writes frame to m within the write timeout,
+// returning ErrMasterClosed when the timeout passes.
+func (wt *WebTTY) writeToMaster(m Master, frame []byte) (int, error) {
+	return wt.deadWriters.writeWithTimeout(m, frame, wt.writeTimeout, ErrMasterClosed)
+}
+
+// writeToSlave writes data to s within the slave write timeout,
+// returning ErrSlaveClosed when the timeout passes.
+func (wt *WebTTY) writeToSlave(s Slave, data []byte) (int, error) {
+	return wt.deadWriters.writeWithTimeout(s, data, wt.slaveWriteTimeout, ErrSlaveClosed)
+}
+
+// deadWriters keeps writers whose write has timed out.
+// They are never written again, as the timed out write can still be going on
+// and most writers such as websockets don't allow concurrent writes.
+type deadWriters struct {
+	mutex   sync.Mutex
+	writers map[io.Writer]struct{}
+}
+
+func (dw *deadWriters) dead(w io.Writer) bool {
+	if !reflect.TypeOf(w).Comparable() {
+		return false
+	}
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	_, ok := dw.writers[w]
+	return ok
+}
+
+// markDead marks w dead. Writers of types that can't be map keys
+// can't be marked.
+func (dw *deadWriters) markDead(w io.Writer) {
+	if !reflect.TypeOf(w).Comparable() {
+		return
+	}
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	if dw.writers == nil {
+		dw.writers = make(map[io.Writer]struct{})
+	}
+	dw.writers[w] = struct{}{}
+}
+
+// writeWithTimeout writes p to w, returning timeoutErr when
+// the write doesn't finish within timeout. Zero timeout waits forever.
+// Writers that can't set a write deadline are written in a goroutine,
+// which is left behind when the write never returns.
+// Once a write times out, later writes to w return timeoutErr without writing.
+func (dw *deadWriters) writeWithTimeout(w io.Writer, p []byte, timeout time.Duration, timeoutErr error) (int, error) {
+	if timeout <= 0 {
+		return w.Write(p)
+	}
+	if dw.dead(w) {
+		return 0, timeoutErr
+	}
+
+	if deadline, ok := w.(deadlineWriter); ok {
+		err := deadline.SetWriteDeadline(time.Now().Add(timeout))
+		if err == nil {
+			n, err := w.Write(p)
+			if isTimeout(err) {
+				dw.markDead(w)
+				return n, timeoutErr
+			}
+			return n, err
+		}
+	}
+
+	// p is reused after returning, while the write can go on
+	p = append([]byte(nil), p...)
+
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := w.Write(p)
+		done <- result{n, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-timer.C:
+		dw.markDead(w)
+		return 0, timeoutErr
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}